@@ -1,12 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	_ "net/http/pprof"
 
+	"github.com/clstb/ipfaas/pkg/scheduler"
 	"github.com/clstb/ipfaas/pkg/server"
 	"github.com/containerd/containerd"
 	"github.com/openfaas/faas-provider/types"
@@ -26,18 +30,109 @@ func main() {
 				Value: "Always",
 				Usage: `Set to "Always" to force a pull of images upon deployment, or "IfNotPresent" to try to use a cached image.`,
 			},
+			&cli.DurationFlag{
+				Name:  "function-timeout",
+				Value: 30 * time.Second,
+				Usage: `Default invocation deadline for functions without an "ipfaas.timeout" annotation.`,
+			},
+			&cli.IntFlag{
+				Name:  "retry-max-attempts",
+				Value: 3,
+				Usage: `Maximum number of nodes tried for functions annotated with "ipfaas.idempotent=true".`,
+			},
+			&cli.DurationFlag{
+				Name:  "retry-budget",
+				Value: time.Minute,
+				Usage: "Total time spent on all attempts of a retried invocation. 0 disables the budget.",
+			},
+			&cli.StringFlag{
+				Name:  "scheduling-policy",
+				Value: scheduler.PolicyP2C,
+				Usage: `Default scheduling policy, one of "p2c", "round-robin", "least-inflight", "resource-aware" or "local-first". Functions override it with the "ipfaas.policy" annotation.`,
+			},
+			&cli.Float64Flag{
+				Name:  "max-cpu",
+				Value: 90,
+				Usage: "CPU usage percentage above which a node only receives work if no other node is available. 0 disables the limit.",
+			},
+			&cli.Float64Flag{
+				Name:  "max-mem",
+				Value: 90,
+				Usage: "Memory usage percentage above which a node only receives work if no other node is available. 0 disables the limit.",
+			},
+			&cli.IntFlag{
+				Name:  "spill-threshold",
+				Value: 256 << 10,
+				Usage: "Payload size in bytes above which offloaded requests and responses are moved through IPFS. 0 disables spilling.",
+			},
+			&cli.IntFlag{
+				Name:  "queue-concurrency",
+				Value: 4,
+				Usage: "Default number of concurrent requests per function and node before requests are queued. 0 disables the limit.",
+			},
+			&cli.DurationFlag{
+				Name:  "queue-timeout",
+				Value: time.Minute,
+				Usage: "Maximum time a synchronous request waits in the queue.",
+			},
+			&cli.DurationFlag{
+				Name:  "queue-max-age",
+				Value: time.Hour,
+				Usage: "Maximum time an asynchronous request waits in the queue before its call fails.",
+			},
+			&cli.DurationFlag{
+				Name:  "scale-to-zero-after",
+				Usage: "Inactivity window after which functions are paused until the next request. 0 disables scaling to zero.",
+			},
+			&cli.IntFlag{
+				Name:  "max-body-size",
+				Value: 1 << 30,
+				Usage: "Maximum size in bytes of image archives uploaded to /system/images.",
+			},
+			&cli.DurationFlag{
+				Name:  "call-ttl",
+				Value: 24 * time.Hour,
+				Usage: "How long the results of finished asynchronous calls are kept for lookup.",
+			},
+			&cli.DurationFlag{
+				Name:  "deploy-timeout",
+				Value: 5 * time.Minute,
+				Usage: "Maximum time to wait for a deployment on another node, including pulling or importing its image.",
+			},
+			&cli.StringSliceFlag{
+				Name:  "label",
+				Usage: `Node label in the form "key=value", matched against function constraints. Can be repeated.`,
+			},
 		},
 		Action: Run,
 	}
 	log.Fatal(app.Run(os.Args))
 }
 
+func parseLabels(values []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, v := range values {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label: %s", v)
+		}
+		labels[kv[0]] = kv[1]
+	}
+
+	return labels, nil
+}
+
 func Run(ctx *cli.Context) error {
 	_, providerConfig, err := config.ReadFromEnv(types.OsEnv{})
 	if err != nil {
 		return err
 	}
 
+	labels, err := parseLabels(ctx.StringSlice("label"))
+	if err != nil {
+		return err
+	}
+
 	cni, err := cninetwork.InitNetwork()
 	if err != nil {
 		return err
@@ -62,6 +157,26 @@ func Run(ctx *cli.Context) error {
 		client,
 		cni,
 		"./ipfs",
+		server.Config{
+			FunctionTimeout:  ctx.Duration("function-timeout"),
+			RetryMaxAttempts: ctx.Int("retry-max-attempts"),
+			RetryBudget:      ctx.Duration("retry-budget"),
+			Scheduler: scheduler.Config{
+				Policy: ctx.String("scheduling-policy"),
+				MaxCPU: ctx.Float64("max-cpu"),
+				MaxMEM: ctx.Float64("max-mem"),
+			},
+			SpillThreshold:   ctx.Int("spill-threshold"),
+			QueueConcurrency: ctx.Int("queue-concurrency"),
+			QueueTimeout:     ctx.Duration("queue-timeout"),
+			QueueMaxAge:      ctx.Duration("queue-max-age"),
+			AlwaysPull:       ctx.String("pull-policy") == "Always",
+			Labels:           labels,
+			ScaleToZeroAfter: ctx.Duration("scale-to-zero-after"),
+			MaxBodySize:      ctx.Int("max-body-size"),
+			CallTTL:          ctx.Duration("call-ttl"),
+			DeployTimeout:    ctx.Duration("deploy-timeout"),
+		},
 	)
 	if err != nil {
 		return err
@@ -0,0 +1,157 @@
+package calls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/clstb/ipfaas/pkg/messages"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var prefix = datastore.NewKey("/ipfaas/calls")
+
+var ErrExists = errors.New("call exists")
+
+// Store persists the state of asynchronous calls in a datastore so they can
+// be looked up after a restart.
+type Store struct {
+	mu sync.Mutex
+	ds datastore.Datastore
+}
+
+func New(ds datastore.Datastore) *Store {
+	return &Store{
+		ds: ds,
+	}
+}
+
+func (s *Store) Put(ctx context.Context, call messages.Call) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.put(ctx, call)
+}
+
+// Create stores a new call. It returns ErrExists if a call with the same id
+// is already stored.
+func (s *Store) Create(ctx context.Context, call messages.Call) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok, err := s.get(ctx, call.Id)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("%w: %s", ErrExists, call.Id)
+	}
+
+	return s.put(ctx, call)
+}
+
+func (s *Store) put(ctx context.Context, call messages.Call) error {
+	b, err := msgpack.Marshal(&call)
+	if err != nil {
+		return fmt.Errorf("marshalling call: %w", err)
+	}
+
+	if err := s.ds.Put(ctx, prefix.ChildString(call.Id), b); err != nil {
+		return fmt.Errorf("storing call: %w", err)
+	}
+
+	return nil
+}
+
+// Get returns the call with the given id. It returns false if the call is
+// not known to this node.
+func (s *Store) Get(ctx context.Context, id string) (messages.Call, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.get(ctx, id)
+}
+
+func (s *Store) get(ctx context.Context, id string) (messages.Call, bool, error) {
+	b, err := s.ds.Get(ctx, prefix.ChildString(id))
+	if errors.Is(err, datastore.ErrNotFound) {
+		return messages.Call{}, false, nil
+	}
+	if err != nil {
+		return messages.Call{}, false, fmt.Errorf("getting call: %w", err)
+	}
+
+	call := messages.Call{}
+	if err := msgpack.Unmarshal(b, &call); err != nil {
+		return messages.Call{}, false, fmt.Errorf("unmarshalling call: %w", err)
+	}
+
+	return call, true, nil
+}
+
+// Update applies f to the stored call with the given id. Unknown calls are
+// left alone.
+func (s *Store) Update(ctx context.Context, id string, f func(*messages.Call)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	call, ok, err := s.get(ctx, id)
+	if err != nil || !ok {
+		return err
+	}
+
+	f(&call)
+
+	return s.put(ctx, call)
+}
+
+func (s *Store) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ds.Delete(ctx, prefix.ChildString(id)); err != nil {
+		return fmt.Errorf("deleting call: %w", err)
+	}
+
+	return nil
+}
+
+// Prune deletes the calls that finished before the given time. Unfinished
+// calls are kept. It returns the number of deleted calls.
+func (s *Store) Prune(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results, err := s.ds.Query(ctx, query.Query{
+		Prefix: prefix.String(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("querying calls: %w", err)
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return 0, fmt.Errorf("querying calls: %w", err)
+	}
+
+	var n int
+	for _, entry := range entries {
+		call := messages.Call{}
+		if err := msgpack.Unmarshal(entry.Value, &call); err != nil {
+			return n, fmt.Errorf("unmarshalling call: %s: %w", entry.Key, err)
+		}
+		if call.FinishedAt == nil || !call.FinishedAt.Before(before) {
+			continue
+		}
+
+		if err := s.ds.Delete(ctx, datastore.NewKey(entry.Key)); err != nil {
+			return n, fmt.Errorf("deleting call: %w", err)
+		}
+		n++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,157 @@
+package calls
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/clstb/ipfaas/pkg/messages"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+)
+
+func open(t *testing.T, path string) *leveldb.Datastore {
+	t.Helper()
+
+	ds, err := leveldb.NewDatastore(path, nil)
+	if err != nil {
+		t.Fatalf("opening datastore: %v", err)
+	}
+	return ds
+}
+
+func TestStoreSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+
+	ds := open(t, path)
+	store := New(ds)
+
+	enqueuedAt := time.Now().UTC().Truncate(time.Millisecond)
+	if err := store.Put(ctx, messages.Call{
+		Id:           "call",
+		FunctionName: "echo",
+		Status:       messages.CallQueued,
+		EnqueuedAt:   enqueuedAt,
+	}); err != nil {
+		t.Fatalf("putting call: %v", err)
+	}
+
+	if err := store.Update(ctx, "call", func(call *messages.Call) {
+		finishedAt := enqueuedAt.Add(time.Second)
+		call.Status = messages.CallDone
+		call.NodeId = "node"
+		call.StatusCode = 200
+		call.Body = []byte("hello")
+		call.FinishedAt = &finishedAt
+	}); err != nil {
+		t.Fatalf("updating call: %v", err)
+	}
+
+	if err := ds.Close(); err != nil {
+		t.Fatalf("closing datastore: %v", err)
+	}
+
+	ds = open(t, path)
+	defer ds.Close()
+	store = New(ds)
+
+	call, ok, err := store.Get(ctx, "call")
+	if err != nil {
+		t.Fatalf("getting call: %v", err)
+	}
+	if !ok {
+		t.Fatal("call not found after restart")
+	}
+	if call.Status != messages.CallDone || call.NodeId != "node" || call.StatusCode != 200 {
+		t.Errorf("unexpected call: %+v", call)
+	}
+	if string(call.Body) != "hello" {
+		t.Errorf("unexpected body: %q", call.Body)
+	}
+	if !call.EnqueuedAt.Equal(enqueuedAt) {
+		t.Errorf("unexpected enqueue time: %v", call.EnqueuedAt)
+	}
+	if call.FinishedAt == nil || !call.FinishedAt.Equal(enqueuedAt.Add(time.Second)) {
+		t.Errorf("unexpected finish time: %v", call.FinishedAt)
+	}
+
+	if err := store.Delete(ctx, "call"); err != nil {
+		t.Fatalf("deleting call: %v", err)
+	}
+	if _, ok, err := store.Get(ctx, "call"); err != nil || ok {
+		t.Errorf("call still present after delete: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestStoreUnknownCall(t *testing.T) {
+	ctx := context.Background()
+
+	ds := open(t, t.TempDir())
+	defer ds.Close()
+	store := New(ds)
+
+	if _, ok, err := store.Get(ctx, "missing"); err != nil || ok {
+		t.Errorf("expected unknown call: ok=%v err=%v", ok, err)
+	}
+
+	updated := false
+	if err := store.Update(ctx, "missing", func(*messages.Call) {
+		updated = true
+	}); err != nil {
+		t.Fatalf("updating unknown call: %v", err)
+	}
+	if updated {
+		t.Error("update applied to unknown call")
+	}
+}
+
+func TestStoreCreateExisting(t *testing.T) {
+	ctx := context.Background()
+
+	ds := open(t, t.TempDir())
+	defer ds.Close()
+	store := New(ds)
+
+	call := messages.Call{Id: "call", Status: messages.CallQueued}
+	if err := store.Create(ctx, call); err != nil {
+		t.Fatalf("creating call: %v", err)
+	}
+	if err := store.Create(ctx, call); !errors.Is(err, ErrExists) {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+}
+
+func TestStorePrune(t *testing.T) {
+	ctx := context.Background()
+
+	ds := open(t, t.TempDir())
+	defer ds.Close()
+	store := New(ds)
+
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	for _, call := range []messages.Call{
+		{Id: "old", Status: messages.CallDone, FinishedAt: &old},
+		{Id: "recent", Status: messages.CallDone, FinishedAt: &now},
+		{Id: "running", Status: messages.CallRunning, EnqueuedAt: old},
+	} {
+		if err := store.Put(ctx, call); err != nil {
+			t.Fatalf("putting call: %v", err)
+		}
+	}
+
+	n, err := store.Prune(ctx, now.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("pruning calls: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 pruned call, got %d", n)
+	}
+
+	for id, want := range map[string]bool{"old": false, "recent": true, "running": true} {
+		if _, ok, err := store.Get(ctx, id); err != nil || ok != want {
+			t.Errorf("call %s: expected present=%v, got %v (err %v)", id, want, ok, err)
+		}
+	}
+}
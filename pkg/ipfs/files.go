@@ -0,0 +1,226 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/clstb/ipfaas/pkg/metrics"
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+var ErrInvalidCID = errors.New("invalid cid")
+
+// maxRecentBlocks bounds the root blocks advertised in heartbeats.
+const maxRecentBlocks = 256
+
+// recentBlocks remembers the root blocks of the files most recently stored or
+// fetched by the node, oldest first.
+type recentBlocks struct {
+	mu   sync.Mutex
+	cids []string
+	set  map[string]struct{}
+}
+
+func (r *recentBlocks) add(c string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.set[c]; ok {
+		return
+	}
+
+	if len(r.cids) == maxRecentBlocks {
+		delete(r.set, r.cids[0])
+		r.cids = r.cids[1:]
+	}
+	r.cids = append(r.cids, c)
+	r.set[c] = struct{}{}
+}
+
+func (r *recentBlocks) remove(c string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.set[c]; !ok {
+		return
+	}
+
+	delete(r.set, c)
+	for j, v := range r.cids {
+		if v == c {
+			r.cids = append(r.cids[:j], r.cids[j+1:]...)
+			break
+		}
+	}
+}
+
+func (r *recentBlocks) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.cids...)
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+
+	return n, err
+}
+
+// fileReader records the bytes read from a file once it is closed.
+type fileReader struct {
+	countingReader
+	f files.File
+}
+
+func (r *fileReader) Close() error {
+	metrics.DataBytes.WithLabelValues(metrics.OpGet).Observe(float64(r.n))
+
+	return r.f.Close()
+}
+
+// GetFile returns the content of the UnixFS file with the given cid,
+// fetching missing blocks from other nodes while reading.
+func (i *IPFS) GetFile(ctx context.Context, s string) ([]byte, error) {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCID, err)
+	}
+
+	node, err := i.Unixfs().Get(ctx, path.IpfsPath(c))
+	if err != nil {
+		return nil, fmt.Errorf("getting file: %w", err)
+	}
+	defer node.Close()
+
+	f, ok := node.(files.File)
+	if !ok {
+		return nil, fmt.Errorf("getting file: %s is not a file", c)
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading file: %w", err)
+	}
+	i.recent.add(c.String())
+	metrics.DataBytes.WithLabelValues(metrics.OpGet).Observe(float64(len(b)))
+
+	return b, nil
+}
+
+// AddFile chunks data into a UnixFS file and returns the cid of its root.
+func (i *IPFS) AddFile(ctx context.Context, data []byte) (string, error) {
+	p, err := i.Unixfs().Add(ctx, files.NewBytesFile(data))
+	if err != nil {
+		return "", fmt.Errorf("adding file: %w", err)
+	}
+
+	c := p.Cid().String()
+	i.recent.add(c)
+	metrics.DataBytes.WithLabelValues(metrics.OpPut).Observe(float64(len(data)))
+
+	return c, nil
+}
+
+// OpenFile returns a reader for the UnixFS file with the given cid. Missing
+// blocks are fetched from other nodes while reading, so large files do not
+// have to fit into memory.
+func (i *IPFS) OpenFile(ctx context.Context, s string) (io.ReadCloser, error) {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCID, err)
+	}
+
+	node, err := i.Unixfs().Get(ctx, path.IpfsPath(c))
+	if err != nil {
+		return nil, fmt.Errorf("getting file: %w", err)
+	}
+
+	f, ok := node.(files.File)
+	if !ok {
+		node.Close()
+		return nil, fmt.Errorf("getting file: %s is not a file", c)
+	}
+	i.recent.add(c.String())
+
+	return &fileReader{countingReader: countingReader{Reader: f}, f: f}, nil
+}
+
+// AddReader chunks the content of r into a UnixFS file and returns the cid
+// of its root.
+func (i *IPFS) AddReader(ctx context.Context, r io.Reader) (string, error) {
+	cr := &countingReader{Reader: r}
+	p, err := i.Unixfs().Add(ctx, files.NewReaderFile(cr))
+	if err != nil {
+		return "", fmt.Errorf("adding file: %w", err)
+	}
+
+	c := p.Cid().String()
+	i.recent.add(c)
+	metrics.DataBytes.WithLabelValues(metrics.OpPut).Observe(float64(cr.n))
+
+	return c, nil
+}
+
+// RemoveFile deletes the locally stored blocks of the file with the given
+// cid. Pinned blocks are kept.
+func (i *IPFS) RemoveFile(ctx context.Context, s string) error {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidCID, err)
+	}
+	i.recent.remove(c.String())
+
+	cids := []cid.Cid{c}
+	for j := 0; j < len(cids); j++ {
+		node, err := i.offline.Dag().Get(ctx, cids[j])
+		if err != nil {
+			// Blocks that are not stored locally have nothing to remove.
+			continue
+		}
+		for _, link := range node.Links() {
+			cids = append(cids, link.Cid)
+		}
+	}
+
+	var rmErr error
+	for _, c := range cids {
+		err := i.offline.Block().Rm(ctx, path.IpfsPath(c), options.Block.Force(true))
+		if err != nil && rmErr == nil {
+			rmErr = fmt.Errorf("removing block %s: %w", c, err)
+		}
+	}
+
+	return rmErr
+}
+
+// HasBlock reports whether the block with the given cid is stored locally.
+// For files this is the root block.
+func (i *IPFS) HasBlock(ctx context.Context, s string) bool {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return false
+	}
+
+	_, err = i.offline.Block().Stat(ctx, path.IpfsPath(c))
+	return err == nil
+}
+
+// RecentBlocks returns the cids of the files most recently stored or fetched
+// by this node.
+func (i *IPFS) RecentBlocks() []string {
+	return i.recent.list()
+}
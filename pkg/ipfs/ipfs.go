@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 
+	"github.com/clstb/ipfaas/pkg/metrics"
+	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-ipfs/config"
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/coreapi"
@@ -13,12 +15,20 @@ import (
 	"github.com/ipfs/go-ipfs/repo/fsrepo"
 	icore "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"go.uber.org/zap"
 )
 
 type IPFS struct {
 	icore.CoreAPI
 	NodeId        string
+	host          host.Host
+	datastore     datastore.Datastore
+	offline       icore.CoreAPI
+	recent        *recentBlocks
 	subscriptions map[string]struct{}
 	messages      chan icore.PubSubMessage
 	logger        *zap.Logger
@@ -88,9 +98,20 @@ func New(
 		return nil, err
 	}
 
+	offline, err := api.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		return nil, err
+	}
+
 	return &IPFS{
-		CoreAPI:       api,
-		NodeId:        node.Identity.String(),
+		CoreAPI:   api,
+		NodeId:    node.Identity.String(),
+		host:      node.PeerHost,
+		datastore: repo.Datastore(),
+		offline:   offline,
+		recent: &recentBlocks{
+			set: map[string]struct{}{},
+		},
 		subscriptions: map[string]struct{}{},
 		messages:      make(chan icore.PubSubMessage, 100),
 		logger:        logger.With(zap.String("component", "ipfs")),
@@ -121,6 +142,10 @@ func (i *IPFS) Subscribe(
 				continue
 			}
 
+			metrics.PubSubMessages.WithLabelValues(
+				metrics.TopicKind(topic),
+				metrics.DirectionReceived,
+			).Inc()
 			i.messages <- msg
 		}
 	}()
@@ -128,6 +153,47 @@ func (i *IPFS) Subscribe(
 	return nil
 }
 
+func (i *IPFS) Publish(
+	ctx context.Context,
+	topic string,
+	data []byte,
+) error {
+	if err := i.PubSub().Publish(ctx, topic, data); err != nil {
+		return err
+	}
+
+	metrics.PubSubMessages.WithLabelValues(
+		metrics.TopicKind(topic),
+		metrics.DirectionPublished,
+	).Inc()
+	return nil
+}
+
+// SetStreamHandler registers a handler for streams opened by other nodes
+// with the given protocol.
+func (i *IPFS) SetStreamHandler(protocol protocol.ID, handler network.StreamHandler) {
+	i.host.SetStreamHandler(protocol, handler)
+}
+
+// NewStream opens a stream to another node speaking the given protocol.
+func (i *IPFS) NewStream(
+	ctx context.Context,
+	nodeId string,
+	protocol protocol.ID,
+) (network.Stream, error) {
+	id, err := peer.Decode(nodeId)
+	if err != nil {
+		return nil, fmt.Errorf("decoding node id: %w", err)
+	}
+
+	return i.host.NewStream(ctx, id, protocol)
+}
+
+// Datastore returns the datastore of the IPFS repository.
+func (i *IPFS) Datastore() datastore.Datastore {
+	return i.datastore
+}
+
 func (i *IPFS) Messages() <-chan icore.PubSubMessage {
 	return i.messages
 }
@@ -1,31 +1,141 @@
 package messages
 
 import (
-	"github.com/valyala/fasthttp"
+	"time"
 )
 
+// FunctionStats describes the executions of a function on a node. Latency is
+// the moving average in microseconds and Inflight the executions running.
+type FunctionStats struct {
+	Latency  float64
+	Inflight int
+}
+
 type Heartbeat struct {
 	NodeId    string
 	UsedMEM   float64
 	UsedCPU   float64
 	Functions []string
+	// ScaledDown lists the functions deployed on the node without a
+	// running replica.
+	ScaledDown  []string
+	Annotations map[string]map[string]string
+	Blocks      []string
+	Stats       map[string]FunctionStats
+	Queued      map[string]int
+	Labels      map[string]string
+	Details     map[string]FunctionDetails
+}
+
+// FunctionDetails describes the deployment of a function on a node.
+type FunctionDetails struct {
+	Image      string
+	Namespace  string
+	Replicas   int
+	Labels     map[string]string
+	EnvProcess string
+	CreatedAt  time.Time
 }
 
 type FunctionResponse struct {
 	FunctionName string
 	Data         []byte
-	Header       fasthttp.ResponseHeader
+	StatusCode   int
+	Header       map[string][]string
 	RequestId    string
+	NodeId       string
 	IsCID        bool
+	Spilled      bool
+	Error        string
 }
 
 type FunctionRequest struct {
 	FunctionName string
 	Data         []byte
+	Method       string
+	Header       map[string][]string
 	Params       string
 	Query        string
 	NodeId       string
 	RequestId    string
 	IsCID        bool
+	Spilled      bool
 	PublishIPFS  bool
+	Timeout      time.Duration
+}
+
+const (
+	CallQueued  = "queued"
+	CallRunning = "running"
+	CallDone    = "done"
+	CallFailed  = "failed"
+)
+
+// Call tracks an asynchronous invocation. The response body is kept in Body,
+// or referenced by ResultCID if it is too large or was published to IPFS.
+type Call struct {
+	Id           string     `json:"id"`
+	FunctionName string     `json:"function"`
+	Status       string     `json:"status"`
+	NodeId       string     `json:"nodeId,omitempty"`
+	StatusCode   int        `json:"statusCode,omitempty"`
+	Body         []byte     `json:"body,omitempty"`
+	ResultCID    string     `json:"resultCid,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	EnqueuedAt   time.Time  `json:"enqueuedAt"`
+	StartedAt    *time.Time `json:"startedAt,omitempty"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty"`
+}
+
+// CallRequest looks up a call on another node.
+type CallRequest struct {
+	Id string
+}
+
+type CallResponse struct {
+	Call *Call
+}
+
+// QueueItem is a function request waiting in the queue of its origin node
+// until a node with capacity pulls it.
+type QueueItem struct {
+	Id          string
+	Origin      string
+	CallbackUrl string
+	Request     FunctionRequest
+	Attempts    int
+	EnqueuedAt  time.Time
+}
+
+const (
+	QueuePull     = "pull"
+	QueueComplete = "complete"
+	QueueNack     = "nack"
+	QueueRelease  = "release"
+)
+
+// QueueRequest pulls an item of FunctionName from a node's queue on behalf
+// of NodeId, or completes or returns the pulled item Id.
+type QueueRequest struct {
+	Op           string
+	NodeId       string
+	FunctionName string
+	Id           string
+	Response     FunctionResponse
+}
+
+type QueueResponse struct {
+	Item  *QueueItem
+	Error string
+}
+
+// DeployRequest carries a function deployment spec to a node that deploys
+// it locally.
+type DeployRequest struct {
+	Body []byte
+}
+
+type DeployResponse struct {
+	StatusCode int
+	Error      string
 }
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "ipfaas"
+
+const (
+	ModeLocal     = "local"
+	ModeOffloaded = "offloaded"
+
+	DirectionReceived  = "received"
+	DirectionPublished = "published"
+
+	OpGet = "get"
+	OpPut = "put"
+)
+
+var (
+	Invocations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "function_invocations_total",
+		Help:      "Function invocations by execution mode and outcome.",
+	}, []string{"function", "mode", "outcome"})
+
+	InvocationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "function_invocation_duration_seconds",
+		Help:      "Duration of function invocations as seen by the scheduling node.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"function", "mode"})
+
+	SchedulerDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scheduler_decisions_total",
+		Help:      "Nodes selected by the scheduler.",
+	}, []string{"function", "node"})
+
+	PubSubMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pubsub_messages_total",
+		Help:      "PubSub messages by topic kind and direction.",
+	}, []string{"topic", "direction"})
+
+	DataBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ipfs_data_bytes",
+		Help:      "Size of data read from and written to IPFS.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+	}, []string{"op"})
+
+	HeartbeatAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "heartbeat_age_seconds",
+		Help:      "Time since the last heartbeat of a node was received.",
+	}, []string{"node"})
+)
+
+// TopicKind strips the function name from per-function topics to keep the
+// cardinality of topic labels bounded.
+func TopicKind(topic string) string {
+	if i := strings.LastIndex(topic, "_"); i >= 0 {
+		return topic[i+1:]
+	}
+
+	return topic
+}
@@ -0,0 +1,253 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/clstb/ipfaas/pkg/messages"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var prefix = datastore.NewKey("/ipfaas/queue")
+
+type lease struct {
+	item      messages.QueueItem
+	expiresAt time.Time
+}
+
+// Queue is a FIFO of function requests per function, persisted in a
+// datastore. Popped items are leased and return to the queue unless they are
+// acknowledged before the lease expires, so every item runs at least once.
+type Queue struct {
+	mu      sync.Mutex
+	ds      datastore.Datastore
+	pending map[string][]messages.QueueItem
+	leases  map[string]lease
+}
+
+// New loads the items persisted in ds. Items leased before a restart are
+// queued again.
+func New(ctx context.Context, ds datastore.Datastore) (*Queue, error) {
+	q := &Queue{
+		ds:      ds,
+		pending: map[string][]messages.QueueItem{},
+		leases:  map[string]lease{},
+	}
+
+	results, err := ds.Query(ctx, query.Query{
+		Prefix: prefix.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("querying queue: %w", err)
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, fmt.Errorf("querying queue: %w", err)
+	}
+
+	for _, entry := range entries {
+		item := messages.QueueItem{}
+		if err := msgpack.Unmarshal(entry.Value, &item); err != nil {
+			return nil, fmt.Errorf("unmarshalling queue item: %s: %w", entry.Key, err)
+		}
+		functionName := item.Request.FunctionName
+		q.pending[functionName] = append(q.pending[functionName], item)
+	}
+	for _, items := range q.pending {
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].EnqueuedAt.Before(items[j].EnqueuedAt)
+		})
+	}
+
+	return q, nil
+}
+
+func (q *Queue) put(ctx context.Context, item messages.QueueItem) error {
+	b, err := msgpack.Marshal(&item)
+	if err != nil {
+		return fmt.Errorf("marshalling queue item: %w", err)
+	}
+
+	if err := q.ds.Put(ctx, prefix.ChildString(item.Id), b); err != nil {
+		return fmt.Errorf("storing queue item: %w", err)
+	}
+
+	return nil
+}
+
+func (q *Queue) Push(ctx context.Context, item messages.QueueItem) error {
+	if err := q.put(ctx, item); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	functionName := item.Request.FunctionName
+	q.pending[functionName] = append(q.pending[functionName], item)
+
+	return nil
+}
+
+// expire queues items with an expired lease again. It must be called with
+// the lock held.
+func (q *Queue) expire() {
+	for id, l := range q.leases {
+		if l.expiresAt.After(time.Now()) {
+			continue
+		}
+		delete(q.leases, id)
+
+		functionName := l.item.Request.FunctionName
+		q.pending[functionName] = append([]messages.QueueItem{l.item}, q.pending[functionName]...)
+	}
+}
+
+// Pop leases the oldest item of a function for the given duration.
+func (q *Queue) Pop(functionName string, duration time.Duration) (messages.QueueItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire()
+
+	items := q.pending[functionName]
+	if len(items) == 0 {
+		return messages.QueueItem{}, false
+	}
+
+	item := items[0]
+	if len(items) == 1 {
+		delete(q.pending, functionName)
+	} else {
+		q.pending[functionName] = items[1:]
+	}
+	q.leases[item.Id] = lease{
+		item:      item,
+		expiresAt: time.Now().Add(duration),
+	}
+
+	return item, true
+}
+
+// Ack removes an item from the queue, whether it is leased or still pending.
+// It returns false if the item is not queued anymore.
+func (q *Queue) Ack(ctx context.Context, id string) (messages.QueueItem, bool, error) {
+	q.mu.Lock()
+	item, ok := q.remove(id)
+	q.mu.Unlock()
+
+	if !ok {
+		return item, false, nil
+	}
+
+	if err := q.ds.Delete(ctx, prefix.ChildString(id)); err != nil {
+		return item, true, fmt.Errorf("deleting queue item: %w", err)
+	}
+
+	return item, true, nil
+}
+
+// remove drops an item from the leases or pending items. It must be called
+// with the lock held.
+func (q *Queue) remove(id string) (messages.QueueItem, bool) {
+	if l, ok := q.leases[id]; ok {
+		delete(q.leases, id)
+		return l.item, true
+	}
+
+	for functionName, items := range q.pending {
+		for i, item := range items {
+			if item.Id != id {
+				continue
+			}
+			q.pending[functionName] = append(items[:i:i], items[i+1:]...)
+			if len(q.pending[functionName]) == 0 {
+				delete(q.pending, functionName)
+			}
+			return item, true
+		}
+	}
+
+	return messages.QueueItem{}, false
+}
+
+// Nack returns a leased item to the front of the queue after a failed
+// attempt.
+func (q *Queue) Nack(ctx context.Context, id string) error {
+	return q.unlease(ctx, id, 1)
+}
+
+// Release returns a leased item to the front of the queue without counting
+// an attempt, e.g. if it was pulled but never run.
+func (q *Queue) Release(ctx context.Context, id string) error {
+	return q.unlease(ctx, id, 0)
+}
+
+func (q *Queue) unlease(ctx context.Context, id string, attempts int) error {
+	q.mu.Lock()
+	l, ok := q.leases[id]
+	if !ok {
+		q.mu.Unlock()
+		return nil
+	}
+	delete(q.leases, id)
+
+	item := l.item
+	item.Attempts += attempts
+	functionName := item.Request.FunctionName
+	q.pending[functionName] = append([]messages.QueueItem{item}, q.pending[functionName]...)
+	q.mu.Unlock()
+
+	return q.put(ctx, item)
+}
+
+// Expire removes the pending items enqueued before the given time and
+// returns them. Leased items are left alone.
+func (q *Queue) Expire(ctx context.Context, before time.Time) ([]messages.QueueItem, error) {
+	q.mu.Lock()
+	var expired []messages.QueueItem
+	for functionName, items := range q.pending {
+		kept := items[:0]
+		for _, item := range items {
+			if item.EnqueuedAt.Before(before) {
+				expired = append(expired, item)
+				continue
+			}
+			kept = append(kept, item)
+		}
+		if len(kept) == 0 {
+			delete(q.pending, functionName)
+			continue
+		}
+		q.pending[functionName] = kept
+	}
+	q.mu.Unlock()
+
+	for _, item := range expired {
+		if err := q.ds.Delete(ctx, prefix.ChildString(item.Id)); err != nil {
+			return expired, fmt.Errorf("deleting queue item: %w", err)
+		}
+	}
+
+	return expired, nil
+}
+
+// Depths returns the number of items waiting per function.
+func (q *Queue) Depths() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire()
+
+	depths := make(map[string]int, len(q.pending))
+	for functionName, items := range q.pending {
+		depths[functionName] = len(items)
+	}
+
+	return depths
+}
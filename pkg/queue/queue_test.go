@@ -0,0 +1,63 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/clstb/ipfaas/pkg/messages"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+func item(id string, enqueuedAt time.Time) messages.QueueItem {
+	return messages.QueueItem{
+		Id:         id,
+		Request:    messages.FunctionRequest{FunctionName: "fn"},
+		EnqueuedAt: enqueuedAt,
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	q, err := New(ctx, ds)
+	if err != nil {
+		t.Fatalf("creating queue: %v", err)
+	}
+
+	now := time.Now()
+	for _, i := range []messages.QueueItem{
+		item("leased", now.Add(-2*time.Hour)),
+		item("old", now.Add(-2*time.Hour)),
+		item("new", now),
+	} {
+		if err := q.Push(ctx, i); err != nil {
+			t.Fatalf("pushing item: %v", err)
+		}
+	}
+	if leased, ok := q.Pop("fn", time.Minute); !ok || leased.Id != "leased" {
+		t.Fatalf("expected to lease the oldest item, got %v", leased.Id)
+	}
+
+	expired, err := q.Expire(ctx, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("expiring items: %v", err)
+	}
+	if len(expired) != 1 || expired[0].Id != "old" {
+		t.Fatalf("expected the old item to expire, got %v", expired)
+	}
+	if depth := q.Depths()["fn"]; depth != 1 {
+		t.Errorf("expected 1 pending item, got %d", depth)
+	}
+
+	// Expired items are gone after a restart too.
+	q, err = New(ctx, ds)
+	if err != nil {
+		t.Fatalf("reloading queue: %v", err)
+	}
+	if depth := q.Depths()["fn"]; depth != 2 {
+		t.Errorf("expected the leased and new item after reload, got %d", depth)
+	}
+}
@@ -0,0 +1,165 @@
+package resolver
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+// DiscoveryError is the error of the last failed attempt to discover a
+// container. Stale is set if the last known good state of the container is
+// served in the meantime.
+type DiscoveryError struct {
+	Container string    `json:"container"`
+	Namespace string    `json:"namespace"`
+	Error     string    `json:"error"`
+	Since     time.Time `json:"since"`
+	Stale     bool      `json:"stale"`
+}
+
+// Discovery is the discovery state of a function.
+type Discovery struct {
+	Name       string           `json:"name"`
+	Containers []string         `json:"containers,omitempty"`
+	Errors     []DiscoveryError `json:"errors,omitempty"`
+}
+
+// discovery remembers the last known good state and the last error of every
+// container, so a single broken container does not make its function
+// disappear.
+type discovery struct {
+	mu       sync.Mutex
+	lastGood map[string]Function
+	errors   map[string]DiscoveryError
+}
+
+func newDiscovery() *discovery {
+	return &discovery{
+		lastGood: map[string]Function{},
+		errors:   map[string]DiscoveryError{},
+	}
+}
+
+func (d *discovery) succeeded(f Function) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := QualifiedName(f.Name, f.Namespace)
+	d.lastGood[key] = f
+	delete(d.errors, key)
+}
+
+// failed records an error and returns the last known good state of the
+// container, if any.
+func (d *discovery) failed(namespace, id string, err error) (Function, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := QualifiedName(id, namespace)
+	f, ok := d.lastGood[key]
+	discoveryErr, failing := d.errors[key]
+	if !failing {
+		discoveryErr.Since = time.Now()
+	}
+	discoveryErr.Container = id
+	discoveryErr.Namespace = namespace
+	discoveryErr.Error = err.Error()
+	discoveryErr.Stale = ok
+	d.errors[key] = discoveryErr
+
+	return f, ok
+}
+
+func (d *discovery) forget(namespace, id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := QualifiedName(id, namespace)
+	delete(d.lastGood, key)
+	delete(d.errors, key)
+}
+
+// prune forgets all containers but the given ones, identified by their
+// qualified names. Containers of the failed namespaces are kept.
+func (d *discovery) prune(ids map[string]struct{}, failed map[string]struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for id, f := range d.lastGood {
+		if _, ok := failed[f.Namespace]; ok {
+			continue
+		}
+		if _, ok := ids[id]; !ok {
+			delete(d.lastGood, id)
+		}
+	}
+	for id, err := range d.errors {
+		if _, ok := failed[err.Namespace]; ok {
+			continue
+		}
+		if _, ok := ids[id]; !ok {
+			delete(d.errors, id)
+		}
+	}
+}
+
+// discover loads a container. Broken containers are served from their last
+// known good state. It returns false if the container does not exist or was
+// never discovered successfully.
+func (r *Resolver) discover(namespace, id string) (Function, bool) {
+	f, err := r.getFunction(namespace, id)
+	switch {
+	case err == nil:
+		r.discovery.succeeded(f)
+		return f, true
+	case errdefs.IsNotFound(err):
+		r.discovery.forget(namespace, id)
+		return Function{}, false
+	default:
+		log.Printf("error getting function %s in %s: %s", id, namespace, err)
+		return r.discovery.failed(namespace, id, err)
+	}
+}
+
+// Discovery returns the discovery state of all functions, including
+// containers that never could be discovered.
+func (r *Resolver) Discovery() []Discovery {
+	r.discovery.mu.Lock()
+	errors := make(map[string]DiscoveryError, len(r.discovery.errors))
+	for key, err := range r.discovery.errors {
+		errors[key] = err
+	}
+	r.discovery.mu.Unlock()
+
+	var discoveries []Discovery
+	r.FunctionURLs.Range(func(key, value interface{}) bool {
+		function := value.(*Function)
+		discovery := Discovery{
+			Name:       function.QualifiedName(),
+			Containers: function.Containers,
+		}
+		for _, container := range function.Containers {
+			key := QualifiedName(container, function.Namespace)
+			if err, ok := errors[key]; ok {
+				discovery.Errors = append(discovery.Errors, err)
+				delete(errors, key)
+			}
+		}
+		discoveries = append(discoveries, discovery)
+		return true
+	})
+	for key, err := range errors {
+		discoveries = append(discoveries, Discovery{
+			Name:   key,
+			Errors: []DiscoveryError{err},
+		})
+	}
+	sort.Slice(discoveries, func(i, j int) bool {
+		return discoveries[i].Name < discoveries[j].Name
+	})
+
+	return discoveries
+}
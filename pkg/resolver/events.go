@@ -0,0 +1,143 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	apievents "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/typeurl"
+)
+
+// resubscribeInterval is the delay before subscribing again after the
+// event stream broke.
+const resubscribeInterval = time.Second
+
+// watch updates functions as soon as containerd reports changes to their
+// containers or tasks.
+func (r *Resolver) watch(ctx context.Context) {
+	for {
+		ch, errCh := r.containerd.Subscribe(ctx, `topic~="^/(tasks|containers|namespaces)/"`)
+
+		err := r.handleEvents(ch, errCh)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("subscribing to containerd events: %s", err)
+
+		time.Sleep(resubscribeInterval)
+		// Catch up on the events missed while not subscribed.
+		if _, err := r.refresh(); err != nil {
+			log.Printf("getting functions: %s", err)
+		}
+	}
+}
+
+func (r *Resolver) handleEvents(ch <-chan *events.Envelope, errCh <-chan error) error {
+	for {
+		select {
+		case envelope := <-ch:
+			if err := r.handleEvent(envelope); err != nil {
+				log.Printf("handling %s event: %s", envelope.Topic, err)
+			}
+		case err := <-errCh:
+			return err
+		}
+	}
+}
+
+func (r *Resolver) handleEvent(envelope *events.Envelope) error {
+	v, err := typeurl.UnmarshalAny(envelope.Event)
+	if err != nil {
+		return fmt.Errorf("unmarshalling event: %w", err)
+	}
+
+	var id string
+	switch e := v.(type) {
+	case *apievents.NamespaceCreate, *apievents.NamespaceUpdate, *apievents.NamespaceDelete:
+		_, err := r.refresh()
+		return err
+	case *apievents.TaskStart:
+		id = e.ContainerID
+	case *apievents.TaskExit:
+		id = e.ContainerID
+	case *apievents.TaskDelete:
+		id = e.ContainerID
+	case *apievents.TaskPaused:
+		id = e.ContainerID
+	case *apievents.TaskResumed:
+		id = e.ContainerID
+	case *apievents.ContainerCreate:
+		id = e.ID
+	case *apievents.ContainerUpdate:
+		id = e.ID
+	case *apievents.ContainerDelete:
+		id = e.ID
+	default:
+		return nil
+	}
+
+	if r.served(envelope.Namespace) {
+		r.refreshContainer(envelope.Namespace, id)
+	}
+	return nil
+}
+
+// refreshContainer reloads the functions a container belongs or belonged
+// to, together with their other containers.
+func (r *Resolver) refreshContainer(namespace, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := map[string]struct{}{}
+	if f, ok := r.discover(namespace, id); ok {
+		names[f.functionName()] = struct{}{}
+	}
+	r.FunctionURLs.Range(func(key, value interface{}) bool {
+		function := value.(*Function)
+		if function.Namespace != namespace {
+			return true
+		}
+		for _, container := range function.Containers {
+			if container == id {
+				names[function.Name] = struct{}{}
+			}
+		}
+		return true
+	})
+
+	ids := map[string]struct{}{id: {}}
+	for name := range names {
+		if function, ok := r.Function(QualifiedName(name, namespace)); ok {
+			for _, container := range function.Containers {
+				ids[container] = struct{}{}
+			}
+		}
+	}
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+
+	members := map[string][]Function{}
+	for _, id := range sorted {
+		f, ok := r.discover(namespace, id)
+		if !ok {
+			continue
+		}
+		members[f.functionName()] = append(members[f.functionName()], f)
+	}
+
+	for name := range names {
+		function, ok := newFunction(name, members[name])
+		if !ok {
+			r.FunctionURLs.Delete(QualifiedName(name, namespace))
+			continue
+		}
+		r.store(function)
+	}
+}
@@ -0,0 +1,73 @@
+package resolver
+
+import (
+	"sync"
+	"time"
+)
+
+// LabelReplicaOf marks a container as additional replica of the function
+// with the given name.
+const LabelReplicaOf = "ipfaas.replica-of"
+
+// unhealthyBackoff is how long a replica is skipped after a failure.
+const unhealthyBackoff = 10 * time.Second
+
+// Replica is a running container of a function.
+type Replica struct {
+	Container string
+	IP        string
+	PID       uint32
+}
+
+func (r Replica) Addr() string {
+	return "http://" + r.IP + ":8080"
+}
+
+// replicas balances requests across the replica sets of functions.
+type replicas struct {
+	mu        sync.Mutex
+	counters  map[string]int
+	unhealthy map[string]time.Time
+}
+
+func newReplicas() *replicas {
+	return &replicas{
+		counters:  map[string]int{},
+		unhealthy: map[string]time.Time{},
+	}
+}
+
+func (r *replicas) markUnhealthy(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.unhealthy[addr] = time.Now().Add(unhealthyBackoff)
+}
+
+// next returns the next healthy replica of a function. If every replica is
+// unhealthy they are all tried again.
+func (r *replicas) next(name string, set []Replica) (Replica, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var healthy []Replica
+	for _, replica := range set {
+		until, ok := r.unhealthy[replica.Addr()]
+		if ok && until.After(time.Now()) {
+			continue
+		}
+		delete(r.unhealthy, replica.Addr())
+		healthy = append(healthy, replica)
+	}
+	if len(healthy) == 0 {
+		healthy = set
+	}
+	if len(healthy) == 0 {
+		return Replica{}, false
+	}
+
+	n := r.counters[name]
+	r.counters[name] = n + 1
+
+	return healthy[n%len(healthy)], true
+}
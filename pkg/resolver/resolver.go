@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/clstb/ipfaas/pkg/messages"
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/opencontainers/runtime-spec/specs-go"
@@ -17,6 +19,31 @@ import (
 
 const annotationLabelPrefix = "com.openfaas.annotations."
 
+// reconcileInterval is how often all functions are listed in addition to
+// the updates driven by containerd events.
+const reconcileInterval = 30 * time.Second
+
+// QualifiedName identifies a function across namespaces as "name.namespace".
+// Functions of the default namespace are identified by their name alone.
+func QualifiedName(name, namespace string) string {
+	if namespace == "" || namespace == faasd.DefaultFunctionNamespace {
+		return name
+	}
+
+	return name + "." + namespace
+}
+
+// ParseName splits a function reference of the form "name" or
+// "name.namespace".
+func ParseName(s string) (string, string) {
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) == 1 {
+		return s, faasd.DefaultFunctionNamespace
+	}
+
+	return parts[0], parts[1]
+}
+
 type Function struct {
 	Name        string
 	Namespace   string
@@ -31,11 +58,41 @@ type Function struct {
 	EnvProcess  string
 	CreatedAt   time.Time
 	ExpiresAt   time.Time
+	// Containers are the containers of the function, running or not.
+	Containers []string
+	// ReplicaSet holds the running replicas. IP and PID are the ones of the
+	// first replica.
+	ReplicaSet []Replica
+}
+
+// Details returns the deployment details advertised to other nodes.
+func (f *Function) Details() messages.FunctionDetails {
+	return messages.FunctionDetails{
+		Image:      f.Image,
+		Namespace:  f.Namespace,
+		Replicas:   f.Replicas,
+		Labels:     f.Labels,
+		EnvProcess: f.EnvProcess,
+		CreatedAt:  f.CreatedAt,
+	}
 }
 
+// QualifiedName returns the name the function is known by to the cluster.
+func (f *Function) QualifiedName() string {
+	return QualifiedName(f.Name, f.Namespace)
+}
+
+// Resolver discovers the functions of all namespaces. FunctionURLs is keyed
+// by their qualified names.
 type Resolver struct {
+	// mu serializes full refreshes and container updates, so a refresh does
+	// not drop functions stored by an event while it was listing.
+	mu           sync.Mutex
 	containerd   *containerd.Client
 	FunctionURLs *sync.Map
+	replicas     *replicas
+	discovery    *discovery
+	namespaces   *sync.Map
 }
 
 func New(
@@ -44,80 +101,282 @@ func New(
 	r := &Resolver{
 		containerd:   containerd,
 		FunctionURLs: &sync.Map{},
+		replicas:     newReplicas(),
+		discovery:    newDiscovery(),
+		namespaces:   &sync.Map{},
 	}
+	r.namespaces.Store(faasd.DefaultFunctionNamespace, struct{}{})
 
+	go r.watch(context.Background())
 	go func() {
-		t := time.NewTicker(2 * time.Second)
+		t := time.NewTicker(reconcileInterval)
 		for range t.C {
-			functions, err := r.listFunctions()
-			if err != nil {
+			if _, err := r.refresh(); err != nil {
 				log.Println("getting functions: %w", err)
 			}
-
-			for _, function := range functions {
-				function.ExpiresAt = time.Now().Add(4 * time.Second)
-				r.FunctionURLs.Store(function.Name, function)
-			}
-			r.FunctionURLs.Range(func(key, value interface{}) bool {
-				function := value.(*Function)
-				if function.ExpiresAt.Before(time.Now()) {
-					r.FunctionURLs.Delete(key)
-				}
-				return true
-			})
 		}
 	}()
 
 	return r
 }
 
+// refresh lists all functions and replaces the known ones. It is the
+// reconciliation for containerd events that were missed.
+func (r *Resolver) refresh() (map[string]*Function, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	functions, failed, err := r.listFunctions()
+	if err != nil {
+		// Keep serving the known functions until containerd answers again.
+		r.FunctionURLs.Range(func(key, value interface{}) bool {
+			r.store(value.(*Function))
+			return true
+		})
+		return functions, err
+	}
+
+	for _, function := range functions {
+		r.store(function)
+	}
+	r.FunctionURLs.Range(func(key, value interface{}) bool {
+		function := value.(*Function)
+		if _, ok := failed[function.Namespace]; ok {
+			r.store(function)
+			return true
+		}
+		if _, ok := functions[key.(string)]; !ok {
+			r.FunctionURLs.Delete(key)
+		}
+		return true
+	})
+
+	return functions, nil
+}
+
+func (r *Resolver) store(function *Function) {
+	function.ExpiresAt = time.Now().Add(2 * reconcileInterval)
+	r.FunctionURLs.Store(function.QualifiedName(), function)
+}
+
+// Resolve returns the address of a running replica of the function with the
+// given qualified name. Replicas are picked round-robin, skipping replicas
+// marked unhealthy unless no other replica is left.
 func (r *Resolver) Resolve(name string) (string, bool) {
 	v, ok := r.FunctionURLs.Load(name)
 	if !ok {
 		return "", false
 	}
 
-	function := v.(*Function)
+	replica, ok := r.replicas.next(name, v.(*Function).ReplicaSet)
+	if !ok {
+		return "", false
+	}
+
+	return replica.Addr(), true
+}
+
+// MarkUnhealthy excludes the replica with the given address from Resolve for
+// a while, e.g. after a connection to it failed.
+func (r *Resolver) MarkUnhealthy(addr string) {
+	r.replicas.markUnhealthy(addr)
+}
+
+func (r *Resolver) Function(name string) (*Function, bool) {
+	v, ok := r.FunctionURLs.Load(name)
+	if !ok {
+		return nil, false
+	}
+
+	return v.(*Function), true
+}
+
+// Refresh reloads the containers of the function with the given qualified
+// name from containerd, e.g. after it was scaled, and returns it.
+func (r *Resolver) Refresh(name string) (*Function, error) {
+	functionName, namespace := ParseName(name)
+	r.refreshContainer(namespace, functionName)
+
+	function, ok := r.Function(name)
+	if !ok {
+		return nil, fmt.Errorf("unable to find function: %s", name)
+	}
+
+	return function, nil
+}
+
+// listNamespaces returns the default namespace and the namespaces carrying
+// the "openfaas" label, like faasd does regardless of its value. Served
+// namespaces whose labels cannot be read are returned as failed.
+func (r *Resolver) listNamespaces() ([]string, []string, error) {
+	ctx := context.Background()
+	store := r.containerd.NamespaceService()
+
+	all, err := store.List(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing namespaces: %w", err)
+	}
+
+	list := []string{faasd.DefaultFunctionNamespace}
+	var failed []string
+	for _, namespace := range all {
+		if namespace == faasd.DefaultFunctionNamespace {
+			continue
+		}
+		labels, err := store.Labels(ctx, namespace)
+		if err != nil {
+			log.Printf("getting labels of namespace %s: %s", namespace, err)
+			if r.served(namespace) {
+				failed = append(failed, namespace)
+			}
+			continue
+		}
+		if _, ok := labels[faasd.NamespaceLabel]; ok {
+			list = append(list, namespace)
+		}
+	}
+
+	return list, failed, nil
+}
 
-	return "http://" + function.IP + ":8080", true
+// served reports whether functions are discovered in a namespace.
+func (r *Resolver) served(namespace string) bool {
+	_, ok := r.namespaces.Load(namespace)
+	return ok
 }
 
-// ListFunctions returns a map of all functions with running tasks on namespace
-func (r *Resolver) listFunctions() (map[string]*Function, error) {
-	ctx := namespaces.WithNamespace(context.Background(), faasd.DefaultFunctionNamespace)
+// ListFunctions returns a map of all functions with running tasks in the
+// served namespaces, keyed by qualified name. Containers that fail to load
+// are served from their last known good state. Containers labelled with
+// "ipfaas.replica-of" are grouped into the replica set of the named
+// function, and left out if that function's own container is gone. It also
+// returns the namespaces that failed to list, whose functions are unknown.
+func (r *Resolver) listFunctions() (map[string]*Function, map[string]struct{}, error) {
 	functions := make(map[string]*Function)
+	failed := map[string]struct{}{}
 
-	containers, err := r.containerd.Containers(ctx)
+	list, failedNamespaces, err := r.listNamespaces()
 	if err != nil {
-		return functions, err
+		return functions, failed, err
+	}
+
+	ids := map[string]struct{}{}
+	served := map[string]struct{}{}
+	for _, namespace := range failedNamespaces {
+		failed[namespace] = struct{}{}
+		served[namespace] = struct{}{}
 	}
+	for _, namespace := range list {
+		served[namespace] = struct{}{}
+		r.namespaces.Store(namespace, struct{}{})
 
-	for _, c := range containers {
-		name := c.ID()
-		f, err := r.getFunction(name)
+		ctx := namespaces.WithNamespace(context.Background(), namespace)
+		containers, err := r.containerd.Containers(ctx)
 		if err != nil {
-			log.Printf("error getting function %s: ", name)
-			return functions, err
+			log.Printf("listing containers of namespace %s: %s", namespace, err)
+			failed[namespace] = struct{}{}
+			continue
+		}
+
+		sort.Slice(containers, func(i, j int) bool {
+			return containers[i].ID() < containers[j].ID()
+		})
+
+		members := map[string][]Function{}
+		for _, c := range containers {
+			ids[QualifiedName(c.ID(), namespace)] = struct{}{}
+			f, ok := r.discover(namespace, c.ID())
+			if !ok {
+				continue
+			}
+
+			name := f.functionName()
+			members[name] = append(members[name], f)
+		}
+
+		for name, containers := range members {
+			function, ok := newFunction(name, containers)
+			if !ok {
+				continue
+			}
+			functions[function.QualifiedName()] = function
 		}
-		functions[name] = &f
 	}
+	r.discovery.prune(ids, failed)
+	r.namespaces.Range(func(key, value interface{}) bool {
+		if _, ok := served[key.(string)]; !ok {
+			r.namespaces.Delete(key)
+		}
+		return true
+	})
 
-	return functions, nil
+	return functions, failed, nil
+}
+
+// functionName returns the name of the function a container belongs to.
+func (f Function) functionName() string {
+	if v := f.Labels[LabelReplicaOf]; v != "" {
+		return v
+	}
+
+	return f.Name
+}
+
+// newFunction groups the containers of a function into its replica set. It
+// returns false if the container named like the function, which describes
+// it, is missing, e.g. because the function was deleted.
+func newFunction(name string, containers []Function) (*Function, bool) {
+	var function Function
+	var ok bool
+	for _, f := range containers {
+		if f.Name == name {
+			function = f
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	function.Name = name
+	function.IP = ""
+	function.PID = 0
+	function.Replicas = 0
+	function.Containers = nil
+	function.ReplicaSet = nil
+
+	for _, f := range containers {
+		function.Containers = append(function.Containers, f.Name)
+		if f.IP == "" {
+			continue
+		}
+		function.Replicas++
+		function.ReplicaSet = append(function.ReplicaSet, Replica{
+			Container: f.Name,
+			IP:        f.IP,
+			PID:       f.PID,
+		})
+	}
+	if len(function.ReplicaSet) > 0 {
+		function.IP = function.ReplicaSet[0].IP
+		function.PID = function.ReplicaSet[0].PID
+	}
+
+	return &function, true
 }
 
-// GetFunction returns a function that matches name
-func (r *Resolver) getFunction(name string) (Function, error) {
-	ctx := namespaces.WithNamespace(context.Background(), faasd.DefaultFunctionNamespace)
+// GetFunction returns a function that matches name in namespace
+func (r *Resolver) getFunction(namespace, name string) (Function, error) {
+	ctx := namespaces.WithNamespace(context.Background(), namespace)
 	fn := Function{}
 
 	c, err := r.containerd.LoadContainer(ctx, name)
 	if err != nil {
-		return Function{}, fmt.Errorf("unable to find function: %s, error %s", name, err)
+		return Function{}, fmt.Errorf("unable to find function: %s, error %w", name, err)
 	}
 
 	image, err := c.Image(ctx)
 	if err != nil {
-		return fn, err
+		return fn, fmt.Errorf("unable to get image for: %s, error %s", name, err)
 	}
 
 	containerName := c.ID()
@@ -143,7 +402,7 @@ func (r *Resolver) getFunction(name string) (Function, error) {
 	secrets := readSecretsFromMounts(spec.Mounts)
 
 	fn.Name = containerName
-	fn.Namespace = faasd.DefaultFunctionNamespace
+	fn.Namespace = namespace
 	fn.Image = image.Name()
 	fn.Labels = labels
 	fn.Annotations = annotations
@@ -0,0 +1,77 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AnnotationConstraints holds the comma separated placement constraints of a
+// function.
+const AnnotationConstraints = "ipfaas.constraints"
+
+const constraintLabelPrefix = "node.labels."
+
+// Constraint restricts a function to nodes with or without a label value.
+type Constraint struct {
+	Key   string
+	Value string
+	Equal bool
+}
+
+// ParseConstraint parses constraints in the style of "node.labels.zone ==
+// edge-a" or "gpu!=true". The node.labels. prefix is optional.
+func ParseConstraint(s string) (Constraint, error) {
+	constraint := Constraint{Equal: true}
+	parts := strings.SplitN(s, "==", 2)
+	if len(parts) != 2 {
+		constraint.Equal = false
+		parts = strings.SplitN(s, "!=", 2)
+	}
+	if len(parts) != 2 {
+		return Constraint{}, fmt.Errorf("invalid constraint: %s", s)
+	}
+
+	constraint.Key = strings.TrimPrefix(strings.TrimSpace(parts[0]), constraintLabelPrefix)
+	constraint.Value = strings.TrimSpace(parts[1])
+	if constraint.Key == "" {
+		return Constraint{}, fmt.Errorf("invalid constraint: %s", s)
+	}
+
+	return constraint, nil
+}
+
+func ParseConstraints(constraints []string) ([]Constraint, error) {
+	var parsed []Constraint
+	for _, s := range constraints {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		constraint, err := ParseConstraint(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, constraint)
+	}
+
+	return parsed, nil
+}
+
+func (c Constraint) Match(labels map[string]string) bool {
+	v, ok := labels[c.Key]
+	if c.Equal {
+		return ok && v == c.Value
+	}
+
+	return !ok || v != c.Value
+}
+
+// Match reports whether labels satisfy all constraints.
+func Match(constraints []Constraint, labels map[string]string) bool {
+	for _, constraint := range constraints {
+		if !constraint.Match(labels) {
+			return false
+		}
+	}
+
+	return true
+}
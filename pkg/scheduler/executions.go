@@ -0,0 +1,89 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/VividCortex/ewma"
+	"github.com/clstb/ipfaas/pkg/messages"
+)
+
+// Executions tracks the functions executed on the local node, no matter
+// which node scheduled them. Its stats are shared through heartbeats.
+type Executions struct {
+	mu         sync.Mutex
+	latencies  map[string]ewma.MovingAverage
+	inflight   map[string]int
+	lastActive map[string]time.Time
+}
+
+func NewExecutions() *Executions {
+	return &Executions{
+		latencies:  map[string]ewma.MovingAverage{},
+		inflight:   map[string]int{},
+		lastActive: map[string]time.Time{},
+	}
+}
+
+// Begin records the start of an execution. The returned function ends it and
+// must be called exactly once.
+func (e *Executions) Begin(functionName string) func() {
+	e.mu.Lock()
+	e.inflight[functionName]++
+	e.mu.Unlock()
+
+	now := time.Now()
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		e.inflight[functionName]--
+		e.lastActive[functionName] = time.Now()
+		avg, ok := e.latencies[functionName]
+		if !ok {
+			avg = ewma.NewMovingAverage()
+			e.latencies[functionName] = avg
+		}
+		avg.Add(float64(time.Since(now).Microseconds()))
+	}
+}
+
+func (e *Executions) Stats() map[string]messages.FunctionStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	stats := map[string]messages.FunctionStats{}
+	for functionName, avg := range e.latencies {
+		stats[functionName] = messages.FunctionStats{
+			Latency: avg.Value(),
+		}
+	}
+	for functionName, inflight := range e.inflight {
+		s := stats[functionName]
+		s.Inflight = inflight
+		stats[functionName] = s
+	}
+
+	return stats
+}
+
+// Inflight returns the number of running executions of a function.
+func (e *Executions) Inflight(functionName string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.inflight[functionName]
+}
+
+// Idle reports whether a function has no running executions and none ended
+// within d.
+func (e *Executions) Idle(functionName string, d time.Duration) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.inflight[functionName] > 0 {
+		return false
+	}
+
+	return time.Since(e.lastActive[functionName]) >= d
+}
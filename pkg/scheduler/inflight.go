@@ -0,0 +1,57 @@
+package scheduler
+
+import (
+	"sync"
+)
+
+// inflight counts the requests currently in flight per node and function.
+type inflight struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newInflight() *inflight {
+	return &inflight{
+		counts: map[string]int{},
+	}
+}
+
+// acquire counts a new request for key. The returned function releases it
+// and may be called more than once.
+func (i *inflight) acquire(key string) func() {
+	i.mu.Lock()
+	i.counts[key]++
+	i.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			i.mu.Lock()
+			defer i.mu.Unlock()
+
+			i.counts[key]--
+			if i.counts[key] <= 0 {
+				delete(i.counts, key)
+			}
+		})
+	}
+}
+
+func (i *inflight) load(key string) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.counts[key]
+}
+
+func (i *inflight) snapshot() map[string]int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	counts := make(map[string]int, len(i.counts))
+	for k, v := range i.counts {
+		counts[k] = v
+	}
+
+	return counts
+}
@@ -0,0 +1,148 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clstb/ipfaas/pkg/messages"
+)
+
+func TestInflightConcurrent(t *testing.T) {
+	i := newInflight()
+
+	var wg sync.WaitGroup
+	for n := 0; n < 100; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := 0; m < 100; m++ {
+				release := i.acquire("node.fn")
+				i.load("node.fn")
+				i.snapshot()
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := i.load("node.fn"); n != 0 {
+		t.Errorf("expected no requests in flight, got %d", n)
+	}
+	if counts := i.snapshot(); len(counts) != 0 {
+		t.Errorf("expected released keys to be removed, got %v", counts)
+	}
+}
+
+func TestInflightDoubleRelease(t *testing.T) {
+	i := newInflight()
+
+	first := i.acquire("node.fn")
+	second := i.acquire("node.fn")
+
+	first()
+	first()
+	if n := i.load("node.fn"); n != 1 {
+		t.Fatalf("expected 1 request in flight after double release, got %d", n)
+	}
+
+	second()
+	if n := i.load("node.fn"); n != 0 {
+		t.Errorf("expected no requests in flight, got %d", n)
+	}
+}
+
+// newTestScheduler returns a scheduler that sees functionName running on
+// the given nodes.
+func newTestScheduler(t *testing.T, functionName string, nodeIds ...string) *Scheduler {
+	t.Helper()
+
+	s, err := New(
+		nodeIds[0],
+		Config{Policy: PolicyLeastInflight},
+		make(chan Latency),
+		make(chan messages.Heartbeat),
+	)
+	if err != nil {
+		t.Fatalf("creating scheduler: %v", err)
+	}
+	s.nodeIdsByFunction.Store(functionName, nodeIds)
+
+	return s
+}
+
+func TestDoReleasesOnError(t *testing.T) {
+	s := newTestScheduler(t, "fn", "a", "b")
+
+	errFailed := errors.New("failed")
+	var wg sync.WaitGroup
+	for n := 0; n < 50; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Do("fn", func(nodeId string) error {
+				return errFailed
+			})
+			if !errors.Is(err, errFailed) {
+				t.Errorf("expected error of f, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counts := s.inflightRequests.snapshot(); len(counts) != 0 {
+		t.Errorf("expected no requests in flight, got %v", counts)
+	}
+}
+
+func TestDoReleasesOnTimeout(t *testing.T) {
+	s := newTestScheduler(t, "fn", "a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	nodeId, err := s.Do("fn", func(nodeId string) error {
+		if n := s.inflightRequests.load(nodeId + ".fn"); n != 1 {
+			t.Errorf("expected request in flight while running, got %d", n)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if nodeId != "a" {
+		t.Errorf("expected node a, got %q", nodeId)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	if n := s.inflightRequests.load("a.fn"); n != 0 {
+		t.Errorf("expected no requests in flight, got %d", n)
+	}
+}
+
+func TestDoMaxInflight(t *testing.T) {
+	s := newTestScheduler(t, "fn", "a")
+
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Do("fn", func(string) error {
+			close(started)
+			<-done
+			return nil
+		}, MaxInflight(1))
+	}()
+	<-started
+
+	nodeId, err := s.Do("fn", func(string) error {
+		t.Error("f ran on a node at its limit")
+		return nil
+	}, MaxInflight(1))
+	if nodeId != "" || !errors.Is(err, ErrOverloaded) {
+		t.Errorf("expected overload, got node %q and %v", nodeId, err)
+	}
+
+	close(done)
+}
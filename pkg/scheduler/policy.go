@@ -0,0 +1,172 @@
+package scheduler
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+const (
+	PolicyP2C           = "p2c"
+	PolicyRoundRobin    = "round-robin"
+	PolicyLeastInflight = "least-inflight"
+	PolicyResourceAware = "resource-aware"
+	PolicyLocalFirst    = "local-first"
+)
+
+// Candidate is a node able to run a function together with the load
+// observed for it at the time of scheduling.
+type Candidate struct {
+	NodeId   string
+	Latency  float64
+	Inflight int
+	UsedCPU  float64
+	UsedMEM  float64
+}
+
+// Saturation is the usage of the most utilised resource of a candidate
+// between 0 and 1.
+func (c Candidate) Saturation() float64 {
+	return math.Max(c.UsedCPU, c.UsedMEM) / 100
+}
+
+// minHeadroom bounds the resource factor of fully saturated candidates.
+const minHeadroom = 0.05
+
+// Load is the expected time for a candidate to complete a new request after
+// its in-flight ones. Like the response time of a queue, it grows with
+// 1/(1-saturation), so a busy node scores worse than an idle one even
+// without requests in flight.
+func (c Candidate) Load() float64 {
+	headroom := math.Max(1-c.Saturation(), minHeadroom)
+	return c.Latency * float64(c.Inflight+1) / headroom
+}
+
+// less reports whether a has less load than b. Candidates without latency
+// observations are compared by saturation.
+func less(a, b Candidate) bool {
+	if a.Load() != b.Load() {
+		return a.Load() < b.Load()
+	}
+
+	return a.Saturation() < b.Saturation()
+}
+
+// Policy selects the node to run a function on. Candidates are never empty
+// and are sorted by node id.
+type Policy interface {
+	Select(functionName string, candidates []Candidate) Candidate
+}
+
+// NewPolicy returns the policy registered under name. nodeId is the local
+// node, used by policies preferring local execution.
+func NewPolicy(name, nodeId string) (Policy, error) {
+	switch name {
+	case PolicyP2C:
+		return P2C{}, nil
+	case PolicyRoundRobin:
+		return &RoundRobin{
+			next: map[string]int{},
+		}, nil
+	case PolicyLeastInflight:
+		return LeastInflight{}, nil
+	case PolicyResourceAware:
+		return ResourceAware{}, nil
+	case PolicyLocalFirst:
+		return LocalFirst{
+			NodeId:   nodeId,
+			Fallback: P2C{},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown scheduling policy: %s", name)
+	}
+}
+
+// P2C picks two random candidates and selects the one with less load.
+type P2C struct{}
+
+func (P2C) Select(functionName string, candidates []Candidate) Candidate {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	first := rand.Intn(len(candidates))
+	second := rand.Intn(len(candidates))
+	for second == first {
+		second = rand.Intn(len(candidates))
+	}
+
+	if less(candidates[first], candidates[second]) {
+		return candidates[first]
+	}
+	return candidates[second]
+}
+
+// RoundRobin cycles through the candidates of each function.
+type RoundRobin struct {
+	mu   sync.Mutex
+	next map[string]int
+}
+
+func (p *RoundRobin) Select(functionName string, candidates []Candidate) Candidate {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i := p.next[functionName] % len(candidates)
+	p.next[functionName] = i + 1
+
+	return candidates[i]
+}
+
+// LeastInflight selects the candidate with the fewest in-flight requests,
+// breaking ties by latency.
+type LeastInflight struct{}
+
+func (LeastInflight) Select(functionName string, candidates []Candidate) Candidate {
+	selected := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if candidate.Inflight < selected.Inflight ||
+			candidate.Inflight == selected.Inflight && candidate.Latency < selected.Latency {
+			selected = candidate
+		}
+	}
+
+	return selected
+}
+
+// ResourceAware selects the candidate with the most free CPU and memory as
+// reported by its heartbeats.
+type ResourceAware struct{}
+
+func (ResourceAware) Select(functionName string, candidates []Candidate) Candidate {
+	usage := func(c Candidate) float64 {
+		return (c.UsedCPU + c.UsedMEM) / 2
+	}
+
+	selected := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if usage(candidate) < usage(selected) {
+			selected = candidate
+		}
+	}
+
+	return selected
+}
+
+// LocalFirst runs functions on the local node whenever it is a candidate and
+// defers to Fallback otherwise.
+type LocalFirst struct {
+	NodeId   string
+	Fallback Policy
+}
+
+func (p LocalFirst) Select(functionName string, candidates []Candidate) Candidate {
+	for _, candidate := range candidates {
+		if candidate.NodeId == p.NodeId {
+			return candidate
+		}
+	}
+
+	return p.Fallback.Select(functionName, candidates)
+}
@@ -0,0 +1,37 @@
+package scheduler
+
+import "testing"
+
+func TestLoadWeighsResources(t *testing.T) {
+	idle := Candidate{NodeId: "idle", Latency: 100}
+	busy := Candidate{NodeId: "busy", Latency: 100, UsedCPU: 89}
+
+	if busy.Load() <= 2*idle.Load() {
+		t.Errorf("expected busy node to weigh more than twice the idle one: %v vs %v", busy.Load(), idle.Load())
+	}
+
+	// A busy node stays preferable to an idle one that is much slower.
+	slow := Candidate{NodeId: "slow", Latency: 10000}
+	if !less(busy, slow) {
+		t.Errorf("expected busy node to beat slow node: %v vs %v", busy.Load(), slow.Load())
+	}
+
+	// Without latency observations saturation decides.
+	idle.Latency, busy.Latency = 0, 0
+	if !less(idle, busy) || less(busy, idle) {
+		t.Error("expected idle node to be preferred without latency observations")
+	}
+}
+
+func TestP2CPrefersIdleNode(t *testing.T) {
+	candidates := []Candidate{
+		{NodeId: "busy", Latency: 100, UsedCPU: 89},
+		{NodeId: "idle", Latency: 100},
+	}
+
+	for n := 0; n < 10; n++ {
+		if selected := (P2C{}).Select("fn", candidates); selected.NodeId != "idle" {
+			t.Fatalf("expected idle node, got %s", selected.NodeId)
+		}
+	}
+}
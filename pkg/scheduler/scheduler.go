@@ -1,43 +1,136 @@
 package scheduler
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/VividCortex/ewma"
 	"github.com/clstb/ipfaas/pkg/messages"
+	"github.com/clstb/ipfaas/pkg/metrics"
 )
 
+// failurePenalty scales the latency recorded for failed invocations so
+// nodes that time out or error are picked less often.
+const failurePenalty = 4
+
+const annotationPolicy = "ipfaas.policy"
+
 type Latency struct {
 	NodeId       string
 	FunctionName string
 	Value        int64
+	Failed       bool
+}
+
+// ErrOverloaded is returned if every node running a function is at its
+// concurrency limit.
+var ErrOverloaded = errors.New("all nodes are at their concurrency limit")
+
+type scheduleOptions struct {
+	exclude     map[string]struct{}
+	prefer      map[string]struct{}
+	maxInflight int
+}
+
+type ScheduleOption func(*scheduleOptions)
+
+// Exclude prevents the given nodes from being scheduled.
+func Exclude(nodeIds ...string) ScheduleOption {
+	return func(o *scheduleOptions) {
+		for _, nodeId := range nodeIds {
+			o.exclude[nodeId] = struct{}{}
+		}
+	}
 }
 
 type heatbeatWithExpiry struct {
 	messages.Heartbeat
-	expiresAt time.Time
+	receivedAt time.Time
+	expiresAt  time.Time
+}
+
+// Prefer restricts scheduling to the given nodes as long as any of them is
+// available and not saturated.
+func Prefer(nodeIds ...string) ScheduleOption {
+	return func(o *scheduleOptions) {
+		for _, nodeId := range nodeIds {
+			o.prefer[nodeId] = struct{}{}
+		}
+	}
+}
+
+// MaxInflight excludes nodes with at least n requests in flight. 0 means no
+// limit.
+func MaxInflight(n int) ScheduleOption {
+	return func(o *scheduleOptions) {
+		o.maxInflight = n
+	}
+}
+
+type Config struct {
+	Policy string
+	// MaxCPU and MaxMEM are the usage percentages above which a node is
+	// considered saturated and only scheduled if no other node is left.
+	MaxCPU float64
+	MaxMEM float64
 }
 
 type Scheduler struct {
+	config            Config
 	latencies         *sync.Map
 	heartbeats        *sync.Map
 	nodeIdsByFunction *sync.Map
-	inflightRequests  *sync.Map
+	// scaledDownByFunction holds the nodes with a function deployed but
+	// without a running replica.
+	scaledDownByFunction *sync.Map
+	inflightRequests     *inflight
+	policies             map[string]Policy
+	defaultPolicy        Policy
 }
 
 func New(
+	nodeId string,
+	config Config,
 	latencyCh <-chan Latency,
 	heartbeatCh <-chan messages.Heartbeat,
-) *Scheduler {
+) (*Scheduler, error) {
 	rand.Seed(time.Now().Unix())
+
+	policies := map[string]Policy{}
+	for _, name := range []string{
+		PolicyP2C,
+		PolicyRoundRobin,
+		PolicyLeastInflight,
+		PolicyResourceAware,
+		PolicyLocalFirst,
+	} {
+		policy, err := NewPolicy(name, nodeId)
+		if err != nil {
+			return nil, err
+		}
+		policies[name] = policy
+	}
+
+	policy, ok := policies[config.Policy]
+	if !ok {
+		return nil, fmt.Errorf("unknown scheduling policy: %s", config.Policy)
+	}
+
 	s := &Scheduler{
-		latencies:         &sync.Map{},
-		heartbeats:        &sync.Map{},
-		nodeIdsByFunction: &sync.Map{},
-		inflightRequests:  &sync.Map{},
+		config:               config,
+		latencies:            &sync.Map{},
+		heartbeats:           &sync.Map{},
+		nodeIdsByFunction:    &sync.Map{},
+		scaledDownByFunction: &sync.Map{},
+		inflightRequests:     newInflight(),
+		policies:             policies,
+		defaultPolicy:        policy,
 	}
 	go func() {
 		ewmas := map[string]ewma.MovingAverage{}
@@ -47,106 +140,418 @@ func New(
 			if !ok {
 				avg = ewma.NewMovingAverage()
 			}
-			avg.Add(float64(latency.Value))
+			value := float64(latency.Value)
+			if latency.Failed {
+				value = math.Max(value, avg.Value()) * failurePenalty
+			}
+			avg.Add(value)
 			ewmas[key] = avg
 			s.latencies.Store(key, avg.Value())
-
-			v, ok := s.inflightRequests.Load(key)
-			if ok {
-				s.inflightRequests.Store(key, v.(int)-1)
-			}
 		}
 	}()
 	go func() {
 		for heartbeat := range heartbeatCh {
 			s.heartbeats.Store(heartbeat.NodeId, heatbeatWithExpiry{
-				Heartbeat: heartbeat,
-				expiresAt: time.Now().Add(10 * time.Second),
+				Heartbeat:  heartbeat,
+				receivedAt: time.Now(),
+				expiresAt:  time.Now().Add(10 * time.Second),
 			})
 		}
 	}()
 	go func() {
 		t := time.NewTicker(3 * time.Second)
 		for range t.C {
-			m := map[string][]string{}
+			running := map[string][]string{}
+			scaledDown := map[string][]string{}
 			s.heartbeats.Range(func(key, value interface{}) bool {
 				heartbeat := value.(heatbeatWithExpiry)
+				metrics.HeartbeatAge.WithLabelValues(heartbeat.NodeId).Set(
+					time.Since(heartbeat.receivedAt).Seconds(),
+				)
 				if heartbeat.expiresAt.Before(time.Now()) {
 					return true
 				}
 				for _, function := range heartbeat.Functions {
-					m[function] = append(m[function], heartbeat.NodeId)
+					running[function] = append(running[function], heartbeat.NodeId)
+				}
+				for _, function := range heartbeat.ScaledDown {
+					scaledDown[function] = append(scaledDown[function], heartbeat.NodeId)
 				}
 				return true
 			})
-			s.inflightRequests.Range(func(key, value interface{}) bool {
-				fmt.Println(key, value)
-				return true
-			})
-			s.latencies.Range(func(key, value interface{}) bool {
-				fmt.Println(key, value)
-				return true
-			})
-			for k, v := range m {
-				s.nodeIdsByFunction.Store(k, v)
-			}
+			replace(s.nodeIdsByFunction, running)
+			replace(s.scaledDownByFunction, scaledDown)
 		}
 	}()
 
-	return s
+	return s, nil
 }
 
-func (s *Scheduler) calcLoad(nodeId, functionName string) (float64, int) {
+// replace sets the content of a sync.Map to m.
+func replace(sm *sync.Map, m map[string][]string) {
+	for k, v := range m {
+		sm.Store(k, v)
+	}
+	sm.Range(func(key, value interface{}) bool {
+		if _, ok := m[key.(string)]; !ok {
+			sm.Delete(key)
+		}
+		return true
+	})
+}
+
+// candidate combines the latency and in-flight requests observed by this
+// node with the execution stats the node advertises in its heartbeats.
+func (s *Scheduler) candidate(nodeId, functionName string) Candidate {
 	key := nodeId + "." + functionName
-	var avg float64
-	v, ok := s.latencies.Load(key)
-	if !ok {
-		avg = 0
+	candidate := Candidate{
+		NodeId:   nodeId,
+		Inflight: s.inflightRequests.load(key),
+	}
+
+	var stats messages.FunctionStats
+	if v, ok := s.heartbeats.Load(nodeId); ok {
+		heartbeat := v.(heatbeatWithExpiry)
+		candidate.UsedCPU = heartbeat.UsedCPU
+		candidate.UsedMEM = heartbeat.UsedMEM
+		stats = heartbeat.Stats[functionName]
+	}
+
+	if v, ok := s.latencies.Load(key); ok {
+		candidate.Latency = v.(float64)
 	} else {
-		avg = v.(float64)
+		candidate.Latency = stats.Latency
 	}
+	if stats.Inflight > candidate.Inflight {
+		candidate.Inflight = stats.Inflight
+	}
+
+	return candidate
+}
 
-	var requests int
-	v, ok = s.inflightRequests.Load(key)
+func (s *Scheduler) saturated(candidate Candidate) bool {
+	if s.config.MaxCPU > 0 && candidate.UsedCPU >= s.config.MaxCPU {
+		return true
+	}
+	if s.config.MaxMEM > 0 && candidate.UsedMEM >= s.config.MaxMEM {
+		return true
+	}
+
+	return false
+}
+
+// policy returns the policy selected by the "ipfaas.policy" annotation of a
+// function, falling back to the default policy.
+func (s *Scheduler) policy(functionName string) Policy {
+	name, ok := s.Annotations(functionName)[annotationPolicy]
 	if !ok {
-		requests = 0
-	} else {
-		requests = v.(int)
+		return s.defaultPolicy
 	}
 
-	return avg * float64(requests), requests
+	policy, ok := s.policies[name]
+	if !ok {
+		return s.defaultPolicy
+	}
+
+	return policy
+}
+
+// constraints returns the placement constraints of a function.
+func (s *Scheduler) constraints(functionName string) ([]Constraint, error) {
+	v := s.Annotations(functionName)[AnnotationConstraints]
+	if v == "" {
+		return nil, nil
+	}
+
+	return ParseConstraints(strings.Split(v, ","))
+}
+
+func (s *Scheduler) labels(nodeId string) map[string]string {
+	v, ok := s.heartbeats.Load(nodeId)
+	if !ok {
+		return nil
+	}
+
+	return v.(heatbeatWithExpiry).Labels
+}
+
+// Annotations returns the annotations of a function as advertised by the
+// nodes running it.
+func (s *Scheduler) Annotations(functionName string) map[string]string {
+	var annotations map[string]string
+	s.heartbeats.Range(func(key, value interface{}) bool {
+		heartbeat := value.(heatbeatWithExpiry)
+		if heartbeat.expiresAt.Before(time.Now()) {
+			return true
+		}
+		v, ok := heartbeat.Annotations[functionName]
+		if !ok {
+			return true
+		}
+		annotations = v
+		return false
+	})
+
+	return annotations
 }
 
-func (s *Scheduler) Schedule(functionName string) (string, error) {
+// Providers returns the nodes advertising the block with the given cid in
+// their heartbeats.
+func (s *Scheduler) Providers(cid string) []string {
+	var nodeIds []string
+	s.heartbeats.Range(func(key, value interface{}) bool {
+		heartbeat := value.(heatbeatWithExpiry)
+		if heartbeat.expiresAt.Before(time.Now()) {
+			return true
+		}
+		for _, block := range heartbeat.Blocks {
+			if block == cid {
+				nodeIds = append(nodeIds, heartbeat.NodeId)
+				break
+			}
+		}
+		return true
+	})
+
+	return nodeIds
+}
+
+// Deployments returns the functions advertised by the nodes, keyed by
+// function name and node id.
+func (s *Scheduler) Deployments() map[string]map[string]messages.FunctionDetails {
+	deployments := map[string]map[string]messages.FunctionDetails{}
+	s.heartbeats.Range(func(key, value interface{}) bool {
+		heartbeat := value.(heatbeatWithExpiry)
+		if heartbeat.expiresAt.Before(time.Now()) {
+			return true
+		}
+		for functionName, details := range heartbeat.Details {
+			if deployments[functionName] == nil {
+				deployments[functionName] = map[string]messages.FunctionDetails{}
+			}
+			deployments[functionName][heartbeat.NodeId] = details
+		}
+		return true
+	})
+
+	return deployments
+}
+
+// Running returns the nodes with a running replica of a function.
+func (s *Scheduler) Running(functionName string) []string {
 	v, ok := s.nodeIdsByFunction.Load(functionName)
 	if !ok {
-		return "", fmt.Errorf("function not found")
+		return nil
 	}
 
-	nodeIds := v.([]string)
-	if len(nodeIds) == 1 {
-		return nodeIds[0], nil
+	return v.([]string)
+}
+
+// Deployed reports whether any node advertises a function, running or
+// scaled down.
+func (s *Scheduler) Deployed(functionName string) bool {
+	if _, ok := s.nodeIdsByFunction.Load(functionName); ok {
+		return true
 	}
+	_, ok := s.scaledDownByFunction.Load(functionName)
+	return ok
+}
+
+// Nodes returns the nodes that sent a heartbeat recently.
+func (s *Scheduler) Nodes() []string {
+	var nodeIds []string
+	s.heartbeats.Range(func(key, value interface{}) bool {
+		heartbeat := value.(heatbeatWithExpiry)
+		if heartbeat.expiresAt.After(time.Now()) {
+			nodeIds = append(nodeIds, heartbeat.NodeId)
+		}
+		return true
+	})
 
-	firstNode := nodeIds[rand.Intn(len(nodeIds))]
-	secondNode := nodeIds[rand.Intn(len(nodeIds))]
-	for secondNode == firstNode {
-		secondNode = nodeIds[rand.Intn(len(nodeIds))]
+	return nodeIds
+}
+
+// Placement returns n nodes satisfying the constraints to deploy a function
+// to, the least utilized first. n <= 0 selects all nodes.
+func (s *Scheduler) Placement(n int, constraints []Constraint) []string {
+	var candidates []Candidate
+	s.heartbeats.Range(func(key, value interface{}) bool {
+		heartbeat := value.(heatbeatWithExpiry)
+		if heartbeat.expiresAt.Before(time.Now()) {
+			return true
+		}
+		if !Match(constraints, heartbeat.Labels) {
+			return true
+		}
+		candidates = append(candidates, Candidate{
+			NodeId:  heartbeat.NodeId,
+			UsedCPU: heartbeat.UsedCPU,
+			UsedMEM: heartbeat.UsedMEM,
+		})
+		return true
+	})
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Saturation() != candidates[j].Saturation() {
+			return candidates[i].Saturation() < candidates[j].Saturation()
+		}
+		return candidates[i].NodeId < candidates[j].NodeId
+	})
+	if n > 0 && n < len(candidates) {
+		candidates = candidates[:n]
 	}
 
-	firstLoad, firstRequests := s.calcLoad(firstNode, functionName)
-	secondLoad, secondRequests := s.calcLoad(secondNode, functionName)
+	nodeIds := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		nodeIds[i] = candidate.NodeId
+	}
 
-	var nodeId string
-	var requests int
-	if firstLoad < secondLoad {
-		nodeId = firstNode
-		requests = firstRequests
-	} else {
-		nodeId = secondNode
-		requests = secondRequests
+	return nodeIds
+}
+
+// Queues returns the nodes advertising queued requests of a function, the
+// node with the most requests first.
+func (s *Scheduler) Queues(functionName string) []string {
+	depths := map[string]int{}
+	s.heartbeats.Range(func(key, value interface{}) bool {
+		heartbeat := value.(heatbeatWithExpiry)
+		if heartbeat.expiresAt.Before(time.Now()) {
+			return true
+		}
+		if depth := heartbeat.Queued[functionName]; depth > 0 {
+			depths[heartbeat.NodeId] = depth
+		}
+		return true
+	})
+
+	nodeIds := make([]string, 0, len(depths))
+	for nodeId := range depths {
+		nodeIds = append(nodeIds, nodeId)
+	}
+	sort.Slice(nodeIds, func(i, j int) bool {
+		return depths[nodeIds[i]] > depths[nodeIds[j]]
+	})
+
+	return nodeIds
+}
+
+// Schedule selects the node to run a function on and counts the request as
+// in flight on it until the returned release function is called.
+func (s *Scheduler) Schedule(functionName string, opts ...ScheduleOption) (string, func(), error) {
+	o := &scheduleOptions{
+		exclude: map[string]struct{}{},
+		prefer:  map[string]struct{}{},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	running, ok := s.nodeIdsByFunction.Load(functionName)
+	scaledDown, scaledDownOk := s.scaledDownByFunction.Load(functionName)
+	if !ok && !scaledDownOk {
+		return "", nil, fmt.Errorf("function not found")
+	}
+
+	constraints, err := s.constraints(functionName)
+	if err != nil {
+		return "", nil, fmt.Errorf("parsing constraints: %w", err)
+	}
+
+	filter := func(v interface{}) []string {
+		if v == nil {
+			return nil
+		}
+		var nodeIds []string
+		for _, nodeId := range v.([]string) {
+			if _, ok := o.exclude[nodeId]; ok {
+				continue
+			}
+			if !Match(constraints, s.labels(nodeId)) {
+				continue
+			}
+			nodeIds = append(nodeIds, nodeId)
+		}
+		return nodeIds
+	}
+
+	// Scaled down nodes are only woken up if no running replica is left.
+	nodeIds := filter(running)
+	if len(nodeIds) == 0 {
+		nodeIds = filter(scaledDown)
+	}
+
+	if len(nodeIds) == 0 {
+		return "", nil, fmt.Errorf("no node available")
+	}
+
+	sort.Strings(nodeIds)
+	var candidates, saturated []Candidate
+	for _, nodeId := range nodeIds {
+		candidate := s.candidate(nodeId, functionName)
+		if o.maxInflight > 0 && candidate.Inflight >= o.maxInflight {
+			continue
+		}
+		if s.saturated(candidate) {
+			saturated = append(saturated, candidate)
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	if len(candidates) == 0 {
+		candidates = saturated
+	}
+	if len(candidates) == 0 {
+		return "", nil, ErrOverloaded
+	}
+
+	// Nodes without any latency observation are assumed to be as fast as the
+	// average node, so they are neither avoided nor stampeded.
+	var sum float64
+	var observed int
+	for _, candidate := range candidates {
+		if candidate.Latency > 0 {
+			sum += candidate.Latency
+			observed++
+		}
+	}
+	if observed > 0 {
+		for i := range candidates {
+			if candidates[i].Latency == 0 {
+				candidates[i].Latency = sum / float64(observed)
+			}
+		}
+	}
+
+	var preferred []Candidate
+	for _, candidate := range candidates {
+		if _, ok := o.prefer[candidate.NodeId]; ok {
+			preferred = append(preferred, candidate)
+		}
+	}
+	if len(preferred) > 0 {
+		candidates = preferred
+	}
+
+	selected := s.policy(functionName).Select(functionName, candidates)
+
+	metrics.SchedulerDecisions.WithLabelValues(functionName, selected.NodeId).Inc()
+	release := s.inflightRequests.acquire(selected.NodeId + "." + functionName)
+	return selected.NodeId, release, nil
+}
+
+// Do schedules a request of a function and runs f with the selected node.
+// The request counts as in flight until f returns, however it returns. The
+// node is empty if scheduling failed.
+func (s *Scheduler) Do(
+	functionName string,
+	f func(nodeId string) error,
+	opts ...ScheduleOption,
+) (string, error) {
+	nodeId, release, err := s.Schedule(functionName, opts...)
+	if err != nil {
+		return "", err
 	}
+	defer release()
 
-	s.inflightRequests.Store(nodeId+"."+functionName, requests+1)
-	return nodeId, nil
+	return nodeId, f(nodeId)
 }
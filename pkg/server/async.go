@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/clstb/ipfaas/pkg/calls"
+	"github.com/clstb/ipfaas/pkg/messages"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/valyala/fasthttp"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.uber.org/zap"
+)
+
+// callsProtocol looks up calls stored on another node.
+const callsProtocol = protocol.ID("/ipfaas/calls/1.0.0")
+
+const (
+	headerCallId      = "X-Call-Id"
+	headerCallbackUrl = "X-Callback-Url"
+
+	callbackTimeout = 10 * time.Second
+)
+
+// copyFunctionRequest detaches a function request from the buffers of the
+// fiber context, which are reused once the handler returns.
+func copyFunctionRequest(req messages.FunctionRequest) messages.FunctionRequest {
+	req.FunctionName = utils.CopyString(req.FunctionName)
+	req.Data = utils.CopyBytes(req.Data)
+	req.Method = utils.CopyString(req.Method)
+	req.Params = utils.CopyString(req.Params)
+	req.Query = utils.CopyString(req.Query)
+
+	return req
+}
+
+// AsyncFunctionHandler queues a function request and answers with 202 and
+// the call id right away. The result is posted to the X-Callback-Url header
+// if given and kept for lookup by call id. A call id given in the X-Call-Id
+// header that is already in use is rejected with 409.
+func (s *Server) AsyncFunctionHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		functionName := c.Params("name")
+		if functionName == "" {
+			return fmt.Errorf("Provide function name in the request path")
+		}
+
+		callId := c.Get(headerCallId)
+		if callId == "" {
+			callId = utils.UUIDv4()
+		}
+		callId = utils.CopyString(callId)
+		callbackUrl := utils.CopyString(c.Get(headerCallbackUrl))
+		req := copyFunctionRequest(newFunctionRequest(qualifiedName(functionName), c))
+		if !s.deployed(req.FunctionName) {
+			return fiber.NewError(
+				fiber.StatusNotFound,
+				fmt.Sprintf("function not found: %s", req.FunctionName),
+			)
+		}
+
+		if err := s.calls.Create(c.Context(), messages.Call{
+			Id:           callId,
+			FunctionName: req.FunctionName,
+			Status:       messages.CallQueued,
+			EnqueuedAt:   time.Now(),
+		}); err != nil {
+			if errors.Is(err, calls.ErrExists) {
+				return fiber.NewError(fiber.StatusConflict, err.Error())
+			}
+			return err
+		}
+
+		if err := s.enqueue(c.Context(), messages.QueueItem{
+			Id:          callId,
+			CallbackUrl: callbackUrl,
+			Request:     req,
+		}); err != nil {
+			if err := s.calls.Delete(c.Context(), callId); err != nil {
+				s.logger.Error("deleting call", zap.Error(err))
+			}
+			return fmt.Errorf("enqueuing function request: %w", err)
+		}
+
+		c.Set(headerCallId, callId)
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+}
+
+// started records that a node began running a queued call.
+func (s *Server) started(ctx context.Context, callId, nodeId string) {
+	now := time.Now()
+	if err := s.calls.Update(ctx, callId, func(call *messages.Call) {
+		call.Status = messages.CallRunning
+		call.NodeId = nodeId
+		call.StartedAt = &now
+	}); err != nil {
+		s.logger.Error("updating call", zap.String("call", callId), zap.Error(err))
+	}
+}
+
+// deliver posts the response of an asynchronous call to its callback url
+// and records the outcome for lookup by call id. Response bodies above the
+// spill threshold are stored in IPFS instead of with the call.
+func (s *Server) deliver(
+	callId string,
+	callbackUrl string,
+	duration time.Duration,
+	res messages.FunctionResponse,
+) {
+	ctx := context.Background()
+	logger := s.logger.With(
+		zap.String("function", res.FunctionName),
+		zap.String("call", callId),
+	)
+
+	if callbackUrl != "" {
+		if err := s.postCallback(callId, callbackUrl, duration, res); err != nil {
+			logger.Error("posting callback", zap.Error(err))
+		}
+	}
+
+	var body []byte
+	var resultCID string
+	switch {
+	case res.Error != "":
+	case res.IsCID:
+		resultCID = string(res.Data)
+	case s.spill(res.Data):
+		cid, err := s.ipfs.AddFile(ctx, res.Data)
+		if err != nil {
+			logger.Error("storing result", zap.Error(err))
+			res.Error = fmt.Sprintf("storing result: %s", err)
+			break
+		}
+		resultCID = cid
+	default:
+		body = res.Data
+	}
+
+	now := time.Now()
+	if err := s.calls.Update(ctx, callId, func(call *messages.Call) {
+		call.Status = messages.CallDone
+		if res.Error != "" {
+			call.Status = messages.CallFailed
+		}
+		call.NodeId = res.NodeId
+		call.StatusCode = res.StatusCode
+		call.Body = body
+		call.ResultCID = resultCID
+		call.Error = res.Error
+		call.FinishedAt = &now
+	}); err != nil {
+		logger.Error("updating call", zap.Error(err))
+	}
+}
+
+func (s *Server) postCallback(
+	callId string,
+	callbackUrl string,
+	duration time.Duration,
+	res messages.FunctionResponse,
+) error {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.SetRequestURI(callbackUrl)
+	req.Header.SetMethod(fiber.MethodPost)
+	for k, values := range res.Header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set(headerCallId, callId)
+	req.Header.Set(headerNodeId, res.NodeId)
+	req.Header.Set("X-Function-Name", res.FunctionName)
+	req.Header.Set("X-Function-Status", strconv.Itoa(res.StatusCode))
+	req.Header.Set("X-Duration-Seconds", strconv.FormatFloat(duration.Seconds(), 'f', -1, 64))
+	req.SetBody(res.Data)
+
+	callbackRes := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(callbackRes)
+
+	if err := s.client.DoTimeout(req, callbackRes, callbackTimeout); err != nil {
+		return err
+	}
+	if callbackRes.StatusCode() >= fiber.StatusBadRequest {
+		return fmt.Errorf("callback returned status %d", callbackRes.StatusCode())
+	}
+
+	return nil
+}
+
+// CallHandler returns the state of a call. Calls unknown to this node are
+// looked up on the other nodes of the cluster.
+func (s *Server) CallHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Params("id")
+		call, ok, err := s.calls.Get(c.Context(), id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			call, ok = s.lookupCall(c.Context(), id)
+		}
+		if !ok {
+			return fiber.ErrNotFound
+		}
+
+		return c.JSON(call)
+	}
+}
+
+// lookupCall asks all other nodes for a call and returns the first match.
+func (s *Server) lookupCall(ctx context.Context, id string) (messages.Call, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var nodeIds []string
+	for _, nodeId := range s.scheduler.Nodes() {
+		if nodeId != s.ipfs.NodeId {
+			nodeIds = append(nodeIds, nodeId)
+		}
+	}
+
+	ch := make(chan *messages.Call, len(nodeIds))
+	for _, nodeId := range nodeIds {
+		go func(nodeId string) {
+			res := messages.CallResponse{}
+			err := s.request(ctx, nodeId, callsProtocol, &messages.CallRequest{Id: id}, &res)
+			if err != nil {
+				s.logger.Debug("looking up call", zap.String("node", nodeId), zap.Error(err))
+			}
+			ch <- res.Call
+		}(nodeId)
+	}
+
+	for range nodeIds {
+		if call := <-ch; call != nil {
+			return *call, true
+		}
+	}
+
+	return messages.Call{}, false
+}
+
+func (s *Server) handleCallsStream(stream network.Stream) {
+	defer stream.Close()
+
+	callRequest := messages.CallRequest{}
+	if err := msgpack.NewDecoder(stream).Decode(&callRequest); err != nil {
+		s.logger.Error("decoding call request", zap.Error(err))
+		stream.Reset()
+		return
+	}
+
+	callResponse := messages.CallResponse{}
+	call, ok, err := s.calls.Get(context.Background(), callRequest.Id)
+	if err != nil {
+		s.logger.Error("getting call", zap.Error(err))
+	}
+	if ok {
+		callResponse.Call = &call
+	}
+
+	if err := msgpack.NewEncoder(stream).Encode(&callResponse); err != nil {
+		s.logger.Error("encoding call response", zap.Error(err))
+		stream.Reset()
+	}
+}
+
+// pruneCalls deletes finished calls once they are older than the configured
+// TTL.
+func (s *Server) pruneCalls(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		n, err := s.calls.Prune(ctx, time.Now().Add(-s.config.CallTTL))
+		if err != nil {
+			s.logger.Error("pruning calls", zap.Error(err))
+		}
+		if n > 0 {
+			s.logger.Debug("pruned calls", zap.Int("count", n))
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	"github.com/clstb/ipfaas/pkg/ipfs"
+	"github.com/clstb/ipfaas/pkg/messages"
+	"github.com/clstb/ipfaas/pkg/scheduler"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/openfaas/faas-provider/types"
+	"github.com/openfaas/faasd/pkg/provider/handlers"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.uber.org/zap"
+)
+
+// deployProtocol carries a function deployment spec to a node, which
+// deploys it to its local containerd.
+const deployProtocol = protocol.ID("/ipfaas/deploy/1.0.0")
+
+const (
+	headerPlacement = "Ipfaas-Placement"
+	placementAll    = "all"
+)
+
+// deployStatus is the outcome of a deployment on a node. Pending is set if
+// the node did not answer in time and may still complete the deployment.
+type deployStatus struct {
+	NodeId     string `json:"nodeId"`
+	StatusCode int    `json:"statusCode"`
+	Error      string `json:"error,omitempty"`
+	Pending    bool   `json:"pending,omitempty"`
+}
+
+// prepareDeployment rewrites a deployment spec before it is handed to faasd.
+// Constraints are kept as annotation, since faasd drops them, and images
+// referenced by cid are imported. It reports whether an image was imported.
+func (s *Server) prepareDeployment(ctx context.Context, body []byte) ([]byte, bool, error) {
+	req := types.FunctionDeployment{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		// Left to the deploy handler to report.
+		return body, false, nil
+	}
+
+	if len(req.Constraints) > 0 {
+		if _, err := scheduler.ParseConstraints(req.Constraints); err != nil {
+			return nil, false, fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		annotations := map[string]string{}
+		if req.Annotations != nil {
+			annotations = *req.Annotations
+		}
+		annotations[scheduler.AnnotationConstraints] = strings.Join(req.Constraints, ",")
+		req.Annotations = &annotations
+	}
+
+	var imported bool
+	if strings.HasPrefix(req.Image, imageScheme) {
+		name, err := s.importImage(ctx, req.Namespace, strings.TrimPrefix(req.Image, imageScheme))
+		if err != nil {
+			code := fiber.StatusBadGateway
+			if errors.Is(err, ipfs.ErrInvalidCID) {
+				code = fiber.StatusBadRequest
+			}
+			return nil, false, fiber.NewError(code, err.Error())
+		}
+		req.Image = name
+		imported = true
+	}
+
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return nil, false, fmt.Errorf("marshalling deployment: %w", err)
+	}
+
+	return body, imported, nil
+}
+
+// deployLocal runs the faasd deploy handler on this node. Images referenced
+// by cid are imported first and never pulled from a registry.
+func (s *Server) deployLocal(ctx context.Context, body []byte) messages.DeployResponse {
+	body, imported, err := s.prepareDeployment(ctx, body)
+	if err != nil {
+		res := errorResponse(messages.FunctionRequest{}, err)
+		return messages.DeployResponse{
+			StatusCode: res.StatusCode,
+			Error:      res.Error,
+		}
+	}
+
+	deployHandler := handlers.MakeDeployHandler(s.containerd, s.cni, "", s.config.AlwaysPull && !imported)
+
+	req := httptest.NewRequest(http.MethodPost, "/system/functions", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	deployHandler(rec, req)
+
+	res := messages.DeployResponse{
+		StatusCode: rec.Code,
+	}
+	if rec.Code >= http.StatusBadRequest {
+		res.Error = strings.TrimSpace(rec.Body.String())
+	}
+
+	return res
+}
+
+func (s *Server) handleDeployStream(stream network.Stream) {
+	defer stream.Close()
+
+	deployRequest := messages.DeployRequest{}
+	if err := msgpack.NewDecoder(stream).Decode(&deployRequest); err != nil {
+		s.logger.Error("decoding deploy request", zap.Error(err))
+		stream.Reset()
+		return
+	}
+
+	deployResponse := s.deployLocal(context.Background(), deployRequest.Body)
+	if deployResponse.Error != "" {
+		s.logger.Error("deploying function", zap.String("error", deployResponse.Error))
+	}
+
+	if err := msgpack.NewEncoder(stream).Encode(&deployResponse); err != nil {
+		s.logger.Error("encoding deploy response", zap.Error(err))
+		stream.Reset()
+	}
+}
+
+// placement returns the nodes a deployment is placed on according to the
+// Ipfaas-Placement header, which is either "all" or a number of nodes, and
+// the constraints of the deployment.
+func (s *Server) placement(v string, constraints []scheduler.Constraint) ([]string, error) {
+	if v == placementAll {
+		return s.scheduler.Placement(0, constraints), nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return nil, fiber.NewError(
+			fiber.StatusBadRequest,
+			fmt.Sprintf("invalid placement: %s", v),
+		)
+	}
+
+	nodeIds := s.scheduler.Placement(n, constraints)
+	if len(nodeIds) < n {
+		return nil, fiber.NewError(
+			fiber.StatusServiceUnavailable,
+			fmt.Sprintf("placement requires %d nodes, %d available", n, len(nodeIds)),
+		)
+	}
+
+	return nodeIds, nil
+}
+
+// DeployHandler deploys a function to the local node, or to the nodes
+// selected by the Ipfaas-Placement header, answering with the status of
+// every node: 200 if all succeeded, 207 if any failed and 202 if some did
+// not answer in time and may still be deploying.
+func (s *Server) DeployHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		v := c.Get(headerPlacement)
+		if v == "" {
+			res := s.deployLocal(c.Context(), c.Body())
+			return c.Status(res.StatusCode).SendString(res.Error)
+		}
+
+		body := utils.CopyBytes(c.Body())
+		spec := types.FunctionDeployment{}
+		if err := json.Unmarshal(body, &spec); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		constraints, err := scheduler.ParseConstraints(spec.Constraints)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		nodeIds, err := s.placement(v, constraints)
+		if err != nil {
+			return err
+		}
+
+		statuses := make([]deployStatus, len(nodeIds))
+		done := make(chan struct{}, len(nodeIds))
+		for i, nodeId := range nodeIds {
+			go func(i int, nodeId string) {
+				defer func() { done <- struct{}{} }()
+
+				statuses[i] = s.deploy(c.Context(), nodeId, body)
+			}(i, nodeId)
+		}
+		for range nodeIds {
+			<-done
+		}
+
+		code := fiber.StatusOK
+		for _, status := range statuses {
+			if status.Error != "" {
+				code = fiber.StatusMultiStatus
+				break
+			}
+			if status.Pending {
+				code = fiber.StatusAccepted
+			}
+		}
+
+		return c.Status(code).JSON(statuses)
+	}
+}
+
+// deploy deploys a function on a node. Deployments pull or import images,
+// so they are bounded by the deploy timeout instead of the stream timeout.
+func (s *Server) deploy(ctx context.Context, nodeId string, body []byte) deployStatus {
+	var res messages.DeployResponse
+	if nodeId == s.ipfs.NodeId {
+		res = s.deployLocal(ctx, body)
+	} else if err := s.requestTimeout(
+		ctx,
+		s.config.DeployTimeout,
+		nodeId,
+		deployProtocol,
+		&messages.DeployRequest{Body: body},
+		&res,
+	); err != nil {
+		if timedOut(err) {
+			return deployStatus{
+				NodeId:     nodeId,
+				StatusCode: fiber.StatusAccepted,
+				Pending:    true,
+			}
+		}
+		return deployStatus{
+			NodeId:     nodeId,
+			StatusCode: fiber.StatusBadGateway,
+			Error:      err.Error(),
+		}
+	}
+
+	return deployStatus{
+		NodeId:     nodeId,
+		StatusCode: res.StatusCode,
+		Error:      res.Error,
+	}
+}
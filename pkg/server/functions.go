@@ -0,0 +1,120 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/clstb/ipfaas/pkg/messages"
+	"github.com/clstb/ipfaas/pkg/resolver"
+	"github.com/clstb/ipfaas/pkg/scheduler"
+	"github.com/gofiber/fiber/v2"
+	"github.com/openfaas/faas-provider/types"
+)
+
+// functionStatus is the cluster view of a function. Replicas are summed up
+// over all nodes hosting it.
+type functionStatus struct {
+	types.FunctionStatus
+	Nodes []string `json:"nodes"`
+}
+
+// functionStatuses merges the functions deployed on this node with the ones
+// advertised by the other nodes, keyed by qualified name.
+func (s *Server) functionStatuses() map[string]*functionStatus {
+	deployments := s.scheduler.Deployments()
+	s.resolver.FunctionURLs.Range(func(key, value interface{}) bool {
+		functionName := key.(string)
+		if deployments[functionName] == nil {
+			deployments[functionName] = map[string]messages.FunctionDetails{}
+		}
+		deployments[functionName][s.ipfs.NodeId] = value.(*resolver.Function).Details()
+		return true
+	})
+
+	statuses := map[string]*functionStatus{}
+	for functionName, nodes := range deployments {
+		name, namespace := resolver.ParseName(functionName)
+		status := &functionStatus{
+			FunctionStatus: types.FunctionStatus{
+				Name:      name,
+				Namespace: namespace,
+			},
+		}
+		for nodeId, details := range nodes {
+			status.Nodes = append(status.Nodes, nodeId)
+			status.Replicas += uint64(details.Replicas)
+			status.AvailableReplicas += uint64(details.Replicas)
+
+			// The most recent deployment describes the function.
+			if details.CreatedAt.Before(status.CreatedAt) {
+				continue
+			}
+			labels := details.Labels
+			status.Image = details.Image
+			status.EnvProcess = details.EnvProcess
+			status.Labels = &labels
+			status.CreatedAt = details.CreatedAt
+		}
+		sort.Strings(status.Nodes)
+
+		annotations := s.annotations(functionName)
+		if annotations != nil {
+			status.Annotations = &annotations
+		}
+		if v := annotations[scheduler.AnnotationConstraints]; v != "" {
+			status.Constraints = strings.Split(v, ",")
+		}
+
+		statuses[functionName] = status
+	}
+
+	return statuses
+}
+
+// ReadHandler lists the functions of a namespace deployed anywhere in the
+// cluster.
+func (s *Server) ReadHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		namespace := functionNamespace(c.Query("namespace"))
+
+		var functions []*functionStatus
+		for _, status := range s.functionStatuses() {
+			if status.Namespace == namespace {
+				functions = append(functions, status)
+			}
+		}
+		sort.Slice(functions, func(i, j int) bool {
+			return functions[i].Name < functions[j].Name
+		})
+		if functions == nil {
+			functions = []*functionStatus{}
+		}
+
+		return c.JSON(functions)
+	}
+}
+
+// ReplicaReaderHandler returns the cluster view of a single function.
+func (s *Server) ReplicaReaderHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		functionName := qualifiedName(c.Params("name"))
+		if namespace := c.Query("namespace"); namespace != "" {
+			functionName = resolver.QualifiedName(c.Params("name"), namespace)
+		}
+
+		status, ok := s.functionStatuses()[functionName]
+		if !ok {
+			return fiber.ErrNotFound
+		}
+
+		return c.JSON(status)
+	}
+}
+
+// DiscoveryHandler reports the local functions together with the containers
+// that currently fail to be discovered.
+func (s *Server) DiscoveryHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(s.resolver.Discovery())
+	}
+}
@@ -1,227 +1,497 @@
 package server
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
+	"net/textproto"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/clstb/ipfaas/pkg/ipfs"
 	"github.com/clstb/ipfaas/pkg/messages"
+	"github.com/clstb/ipfaas/pkg/metrics"
+	"github.com/clstb/ipfaas/pkg/resolver"
 	"github.com/clstb/ipfaas/pkg/scheduler"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/utils"
-	"github.com/ipfs/go-cid"
-	"github.com/ipfs/interface-go-ipfs-core/path"
 	"github.com/valyala/fasthttp"
-	"github.com/vmihailenco/msgpack/v5"
+	"go.uber.org/zap"
 )
 
-func (s *Server) handleFunctionRequest(functionRequest messages.FunctionRequest) error {
-	ctx := context.Background()
+const (
+	annotationTimeout    = "ipfaas.timeout"
+	annotationIdempotent = "ipfaas.idempotent"
+	headerNodeId         = "Ipfaas-Node-Id"
+)
+
+// annotations returns the annotations of a function, preferring the local
+// deployment over the ones advertised by other nodes.
+func (s *Server) annotations(functionName string) map[string]string {
+	if function, ok := s.resolver.Function(functionName); ok {
+		return function.Annotations
+	}
+
+	return s.scheduler.Annotations(functionName)
+}
+
+// functionTimeout returns the invocation deadline of a function, read from
+// its "ipfaas.timeout" annotation and falling back to the configured default.
+func (s *Server) functionTimeout(functionName string) time.Duration {
+	v, ok := s.annotations(functionName)[annotationTimeout]
+	if !ok {
+		return s.config.FunctionTimeout
+	}
+
+	timeout, err := time.ParseDuration(v)
+	if err != nil || timeout <= 0 {
+		s.logger.Warn(
+			"invalid function timeout",
+			zap.String("function", functionName),
+			zap.String("timeout", v),
+		)
+		return s.config.FunctionTimeout
+	}
+
+	return timeout
+}
+
+// do calls the function with req and returns once the call finished or ctx
+// is done. The call runs on copies of req and res so an abandoned call can
+// complete in the background without touching buffers owned by the caller.
+func (s *Server) do(ctx context.Context, req *fasthttp.Request, res *fasthttp.Response) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return s.client.Do(req, res)
+	}
+
+	callReq := fasthttp.AcquireRequest()
+	req.CopyTo(callReq)
+	callRes := fasthttp.AcquireResponse()
+	release := func() {
+		fasthttp.ReleaseRequest(callReq)
+		fasthttp.ReleaseResponse(callRes)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.client.DoDeadline(callReq, callRes, deadline)
+	}()
+
+	select {
+	case err := <-errCh:
+		defer release()
+		if errors.Is(err, fasthttp.ErrTimeout) {
+			return context.DeadlineExceeded
+		}
+		if err != nil {
+			return err
+		}
+		callRes.CopyTo(res)
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-errCh
+			release()
+		}()
+		return ctx.Err()
+	}
+}
 
+// errorResponse turns an error of a failed invocation into a response. The
+// status code is taken from a *fiber.Error and defaults to 500.
+func errorResponse(functionRequest messages.FunctionRequest, err error) messages.FunctionResponse {
+	code := fiber.StatusInternalServerError
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		code = fiberErr.Code
+	}
+
+	return messages.FunctionResponse{
+		FunctionName: functionRequest.FunctionName,
+		RequestId:    functionRequest.RequestId,
+		StatusCode:   code,
+		Error:        err.Error(),
+	}
+}
+
+func (s *Server) executeFunctionRequest(
+	ctx context.Context,
+	functionRequest messages.FunctionRequest,
+) (messages.FunctionResponse, error) {
 	functionName := functionRequest.FunctionName
-	addr, ok := s.resolver.Resolve(functionRequest.FunctionName)
+
+	// The execution starts before the function is resolved, so it is not
+	// scaled down while its input is fetched or it is scaled up.
+	end := s.executions.Begin(functionName)
+	defer end()
+
+	addr, ok := s.resolver.Resolve(functionName)
 	if !ok {
-		return fmt.Errorf("resolving function: %s", functionName)
+		if _, ok := s.resolver.Function(functionName); !ok {
+			return messages.FunctionResponse{}, fiber.NewError(
+				fiber.StatusServiceUnavailable,
+				fmt.Sprintf("resolving function: %s", functionName),
+			)
+		}
+
+		var err error
+		if addr, err = s.scaleUp(ctx, functionName); err != nil {
+			return messages.FunctionResponse{}, fiber.NewError(
+				fiber.StatusServiceUnavailable,
+				fmt.Sprintf("scaling up function: %s: %s", functionName, err),
+			)
+		}
 	}
 
 	url, err := url.Parse(addr)
 	if err != nil {
-		return fmt.Errorf("parsing function address: %w", err)
+		return messages.FunctionResponse{}, fmt.Errorf("parsing function address: %w", err)
 	}
 	url.Path = functionRequest.Params
 	url.RawQuery = functionRequest.Query
 
 	if functionRequest.IsCID {
-		cid, err := cid.Decode(string(functionRequest.Data))
-		if err != nil {
-			return fmt.Errorf("casting cid: %w", err)
-		}
-
-		r, err := s.ipfs.Block().Get(ctx, path.IpfsPath(cid))
+		data, err := s.ipfs.GetFile(ctx, string(functionRequest.Data))
 		if err != nil {
-			return fmt.Errorf("getting block: %w", err)
-		}
-
-		functionRequest.Data, err = io.ReadAll(r)
-		if err != nil {
-			return fmt.Errorf("reading block: %w", err)
+			code := fiber.StatusBadGateway
+			if errors.Is(err, ipfs.ErrInvalidCID) {
+				code = fiber.StatusBadRequest
+			}
+			return messages.FunctionResponse{}, fiber.NewError(code, err.Error())
 		}
+		functionRequest.Data = data
 	}
 
 	req := fasthttp.AcquireRequest()
 	defer fasthttp.ReleaseRequest(req)
 
 	req.SetRequestURI(url.String())
+	if functionRequest.Method != "" {
+		req.Header.SetMethod(functionRequest.Method)
+	}
+	for k, values := range functionRequest.Header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
 	req.SetBody(functionRequest.Data)
 
 	res := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(res)
 
-	if err := s.client.Do(req, res); err != nil {
-		return fmt.Errorf("calling function: %s: %w", functionName, err)
+	if err := s.do(ctx, req, res); err != nil {
+		code := fiber.StatusBadGateway
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			code = fiber.StatusGatewayTimeout
+		case !errors.Is(err, context.Canceled):
+			s.resolver.MarkUnhealthy(addr)
+		}
+		return messages.FunctionResponse{}, fiber.NewError(
+			code,
+			fmt.Sprintf("calling function: %s: %s", functionName, err),
+		)
 	}
 
+	// The body is owned by res, which goes back to the pool on return.
 	functionResponse := messages.FunctionResponse{
-		FunctionName: functionRequest.FunctionName,
-		Data:         res.Body(),
-		Header:       res.Header,
+		FunctionName: functionName,
+		Data:         utils.CopyBytes(res.Body()),
+		StatusCode:   res.StatusCode(),
+		Header:       map[string][]string{},
 		RequestId:    functionRequest.RequestId,
 	}
+	res.Header.VisitAll(func(key, value []byte) {
+		k := string(key)
+		functionResponse.Header[k] = append(functionResponse.Header[k], string(value))
+	})
 
 	if functionRequest.PublishIPFS {
-		block, err := s.ipfs.Block().Put(ctx, bytes.NewReader(functionResponse.Data))
+		cid, err := s.ipfs.AddFile(ctx, functionResponse.Data)
 		if err != nil {
-			return fmt.Errorf("putting block: %w", err)
+			return messages.FunctionResponse{}, err
 		}
 
-		functionResponse.Data = []byte(block.Path().Cid().String())
+		functionResponse.Data = []byte(cid)
 		functionResponse.IsCID = true
 	}
 
-	b, err := msgpack.Marshal(&functionResponse)
-	if err != nil {
-		return fmt.Errorf("marshalling message: %w", err)
-	}
-
-	if err := s.ipfs.PubSub().Publish(
-		ctx,
-		functionName+"_responses",
-		b,
-	); err != nil {
-		return fmt.Errorf("publishing message: %w", err)
-	}
+	return functionResponse, nil
+}
 
-	return nil
+// hopHeaders are connection specific and not forwarded to functions.
+var hopHeaders = map[string]struct{}{
+	"Connection":          {},
+	"Content-Length":      {},
+	"Host":                {},
+	"Keep-Alive":          {},
+	"Proxy-Authenticate":  {},
+	"Proxy-Authorization": {},
+	"Proxy-Connection":    {},
+	"Te":                  {},
+	"Trailer":             {},
+	"Transfer-Encoding":   {},
+	"Upgrade":             {},
 }
 
-func (s *Server) FunctionHandler() fiber.Handler {
-	offload := func(functionName, nodeId string, c *fiber.Ctx) error {
-		requestId := utils.UUIDv4()
-
-		ch := make(chan messages.FunctionResponse, 1)
-		headers := c.GetReqHeaders()
-		_, isCID := headers["Ipfaas-Is-Cid"]
-		_, publishIpfs := headers["Ipfaas-Publish-Ipfs"]
-
-		req := messages.FunctionRequest{
-			FunctionName: functionName,
-			Data:         c.Body(),
-			Params:       c.Params("params"),
-			Query:        string(c.Request().URI().QueryString()),
-			NodeId:       nodeId,
-			RequestId:    requestId,
-			IsCID:        isCID,
-			PublishIPFS:  publishIpfs,
-		}
-
-		b, err := msgpack.Marshal(&req)
-		if err != nil {
-			return fmt.Errorf("marshalling message: %w", err)
+// forwardedHeaders returns the request headers that are replayed on the
+// executing node, leaving out hop-by-hop and ipfaas control headers.
+func forwardedHeaders(req *fasthttp.Request) map[string][]string {
+	header := map[string][]string{}
+	req.Header.VisitAll(func(key, value []byte) {
+		k := textproto.CanonicalMIMEHeaderKey(string(key))
+		if _, ok := hopHeaders[k]; ok {
+			return
+		}
+		if strings.HasPrefix(k, "Ipfaas-") {
+			return
 		}
+		header[k] = append(header[k], string(value))
+	})
 
-		s.offloads.Store(requestId, ch)
-		defer s.offloads.Delete(requestId)
+	return header
+}
 
-		if err := s.ipfs.Subscribe(c.Context(), functionName+"_responses"); err != nil {
-			return err
-		}
+// qualifiedName normalizes a function reference of the form "name" or
+// "name.namespace" from a request path.
+func qualifiedName(s string) string {
+	return resolver.QualifiedName(resolver.ParseName(s))
+}
+
+func newFunctionRequest(functionName string, c *fiber.Ctx) messages.FunctionRequest {
+	headers := c.GetReqHeaders()
+	_, isCID := headers["Ipfaas-Is-Cid"]
+	_, publishIpfs := headers["Ipfaas-Publish-Ipfs"]
+
+	return messages.FunctionRequest{
+		FunctionName: functionName,
+		Data:         c.Body(),
+		Method:       c.Method(),
+		Header:       forwardedHeaders(c.Request()),
+		Params:       "/" + c.Params("*"),
+		Query:        string(c.Request().URI().QueryString()),
+		IsCID:        isCID,
+		PublishIPFS:  publishIpfs,
+	}
+}
 
-		if err := s.ipfs.PubSub().Publish(
-			c.Context(),
-			functionName+"_requests",
-			b,
-		); err != nil {
-			return fmt.Errorf("publishing message: %w", err)
+func writeFunctionResponse(c *fiber.Ctx, res messages.FunctionResponse) error {
+	c.Set(headerNodeId, res.NodeId)
+	for k, values := range res.Header {
+		for _, v := range values {
+			c.Response().Header.Add(k, v)
 		}
+	}
+	c.Status(res.StatusCode)
+	return c.Send(res.Data)
+}
 
-		now := time.Now()
-		defer func() {
-			s.latencyCh <- scheduler.Latency{
-				NodeId:       nodeId,
-				FunctionName: functionName,
-				Value:        time.Since(now).Microseconds(),
-			}
-		}()
+// providers returns the nodes known to store the block with the given cid.
+func (s *Server) providers(ctx context.Context, cid string) []string {
+	providers := s.scheduler.Providers(cid)
+	if s.ipfs.HasBlock(ctx, cid) {
+		providers = append(providers, s.ipfs.NodeId)
+	}
 
-		res := <-ch
+	return providers
+}
 
-		c.Response().Header = res.Header
-		return c.Send(res.Data)
+// retryable reports whether an invocation failed because of the executing
+// node rather than the request itself. Invocations canceled by the caller
+// are not retried.
+func retryable(ctx context.Context, err error) bool {
+	if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+		return false
 	}
-	handle := func(functionName string, c *fiber.Ctx) error {
-		addr, ok := s.resolver.Resolve(functionName)
-		if !ok {
-			return fmt.Errorf("resolving function")
-		}
 
-		req := c.Request()
-		headers := c.GetReqHeaders()
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return fiberErr.Code >= fiber.StatusInternalServerError
+	}
 
-		req.SetRequestURI(addr)
+	return true
+}
 
-		_, isCID := headers["Ipfaas-Is-Cid"]
-		if isCID {
-			cid, err := cid.Decode(string(req.Body()))
-			if err != nil {
-				return fmt.Errorf("casting cid: %w", err)
-			}
+// idempotent reports whether a function opted into retries with the
+// "ipfaas.idempotent" annotation.
+func (s *Server) idempotent(functionName string) bool {
+	idempotent, _ := strconv.ParseBool(s.annotations(functionName)[annotationIdempotent])
+	return idempotent
+}
 
-			r, err := s.ipfs.Block().Get(c.Context(), path.IpfsPath(cid))
-			if err != nil {
-				return fmt.Errorf("getting block: %w", err)
-			}
+// observe feeds the outcome of an invocation into the scheduler and metrics.
+func (s *Server) observe(
+	ctx context.Context,
+	nodeId string,
+	functionName string,
+	mode string,
+	duration time.Duration,
+	err error,
+) {
+	s.latencyCh <- scheduler.Latency{
+		NodeId:       nodeId,
+		FunctionName: functionName,
+		Value:        duration.Microseconds(),
+		Failed:       err != nil && retryable(ctx, err),
+	}
 
-			b, err := io.ReadAll(r)
-			if err != nil {
-				return fmt.Errorf("reading block: %w", err)
-			}
-			req.SetBody(b)
-		}
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	metrics.Invocations.WithLabelValues(functionName, mode, outcome).Inc()
+	metrics.InvocationDuration.WithLabelValues(functionName, mode).Observe(duration.Seconds())
+}
 
-		now := time.Now()
-		defer func() {
-			s.latencyCh <- scheduler.Latency{
-				NodeId:       s.ipfs.NodeId,
-				FunctionName: functionName,
-				Value:        time.Since(now).Microseconds(),
-			}
-		}()
+func (s *Server) offload(
+	ctx context.Context,
+	nodeId string,
+	req messages.FunctionRequest,
+	timeout time.Duration,
+) (res messages.FunctionResponse, err error) {
+	req.NodeId = nodeId
+	req.RequestId = utils.UUIDv4()
+	req.Timeout = timeout
+
+	now := time.Now()
+	parent := ctx
+	defer func() {
+		s.observe(parent, nodeId, req.FunctionName, metrics.ModeOffloaded, time.Since(now), err)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return s.invoke(ctx, nodeId, req)
+}
+
+func (s *Server) handle(
+	ctx context.Context,
+	req messages.FunctionRequest,
+	timeout time.Duration,
+) (res messages.FunctionResponse, err error) {
+	req.NodeId = s.ipfs.NodeId
+	req.RequestId = utils.UUIDv4()
+
+	now := time.Now()
+	parent := ctx
+	defer func() {
+		s.observe(parent, s.ipfs.NodeId, req.FunctionName, metrics.ModeLocal, time.Since(now), err)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	res, err = s.executeFunctionRequest(ctx, req)
+	if err != nil {
+		return res, err
+	}
+	res.NodeId = s.ipfs.NodeId
+
+	return res, nil
+}
+
+// call schedules a function request and executes it, retrying idempotent
+// functions on other nodes. It returns the node that handled the last attempt.
+func (s *Server) call(
+	ctx context.Context,
+	req messages.FunctionRequest,
+) (messages.FunctionResponse, string, error) {
+	functionName := req.FunctionName
+	timeout := s.functionTimeout(functionName)
+
+	var preferred []string
+	if req.IsCID {
+		preferred = s.providers(ctx, string(req.Data))
+	}
 
-		res := c.Response()
-		if err := s.client.Do(req, res); err != nil {
-			return fmt.Errorf("calling function: %s: %w", functionName, err)
+	attempts := 1
+	if s.idempotent(functionName) && s.config.RetryMaxAttempts > 1 {
+		attempts = s.config.RetryMaxAttempts
+	}
+	// A budget of 0 leaves the attempts bounded by the function timeout only.
+	var budget time.Time
+	if s.config.RetryBudget > 0 {
+		budget = time.Now().Add(s.config.RetryBudget)
+	}
+
+	var failed []string
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		attemptTimeout := timeout
+		if attempts > 1 && !budget.IsZero() {
+			if remaining := time.Until(budget); remaining < attemptTimeout {
+				attemptTimeout = remaining
+			}
 		}
 
-		_, publishIpfs := headers["Ipfaas-Publish-Ipfs"]
-		if publishIpfs {
-			block, err := s.ipfs.Block().Put(c.Context(), bytes.NewReader(res.Body()))
-			if err != nil {
-				return fmt.Errorf("putting block: %w", err)
+		var res messages.FunctionResponse
+		nodeId, err := s.scheduler.Do(
+			functionName,
+			func(nodeId string) (err error) {
+				if nodeId == s.ipfs.NodeId {
+					res, err = s.handle(ctx, req, attemptTimeout)
+				} else {
+					res, err = s.offload(ctx, nodeId, req, attemptTimeout)
+				}
+				return err
+			},
+			scheduler.Exclude(failed...),
+			scheduler.Prefer(preferred...),
+			scheduler.MaxInflight(s.maxConcurrency(functionName)),
+		)
+		if nodeId == "" {
+			if lastErr != nil {
+				return messages.FunctionResponse{}, failed[len(failed)-1], lastErr
 			}
+			return messages.FunctionResponse{}, "", fmt.Errorf("scheduling: %w", err)
+		}
+		if err == nil {
+			return res, nodeId, nil
+		}
 
-			res.SetBodyString(block.Path().Cid().String())
+		if attempt >= attempts || !retryable(ctx, err) || (!budget.IsZero() && time.Until(budget) <= 0) {
+			return res, nodeId, err
 		}
 
-		return nil
+		s.logger.Warn(
+			"retrying function",
+			zap.String("function", functionName),
+			zap.String("node", nodeId),
+			zap.Int("attempt", attempt),
+			zap.Error(err),
+		)
+		failed = append(failed, nodeId)
+		lastErr = err
 	}
+}
 
+func (s *Server) FunctionHandler() fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		functionName := c.Params("name")
 		if functionName == "" {
 			return fmt.Errorf("Provide function name in the request path")
 		}
 
-		nodeId, err := s.scheduler.Schedule(functionName)
+		req := newFunctionRequest(qualifiedName(functionName), c)
+		res, nodeId, err := s.call(c.Context(), req)
+		if errors.Is(err, scheduler.ErrOverloaded) {
+			res, err = s.wait(c.Context(), messages.QueueItem{
+				Id:      utils.UUIDv4(),
+				Request: copyFunctionRequest(req),
+			})
+			nodeId = res.NodeId
+		}
 		if err != nil {
-			return fmt.Errorf("scheduling: %w", err)
+			if nodeId != "" {
+				c.Set(headerNodeId, nodeId)
+			}
+			return err
 		}
 
-		if nodeId == s.ipfs.NodeId {
-			return handle(functionName, c)
-		}
-		return offload(functionName, nodeId, c)
+		return writeFunctionResponse(c, res)
 	}
 }
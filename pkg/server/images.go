@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/clstb/ipfaas/pkg/ipfs"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ipfs/go-cid"
+	faasd "github.com/openfaas/faasd/pkg"
+)
+
+const (
+	// imageScheme marks function images that are distributed over IPFS as
+	// OCI archives, e.g. ipfs://bafy...
+	imageScheme = "ipfs://"
+	// imageDomain is the registry domain imported images are tagged with.
+	imageDomain = "ipfs.local"
+
+	imagesPath = "/system/images"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitReader fails with errBodyTooLarge once more than n bytes are read.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errBodyTooLarge
+	}
+
+	return n, err
+}
+
+type imageRequest struct {
+	Image     string `json:"image"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type imageResponse struct {
+	CID   string `json:"cid"`
+	Image string `json:"image"`
+}
+
+func functionNamespace(namespace string) string {
+	if namespace == "" {
+		return faasd.DefaultFunctionNamespace
+	}
+
+	return namespace
+}
+
+// imageName returns the name an image archive stored in IPFS is imported
+// as. The cid is converted to v1 so the name is a valid lowercase reference.
+func imageName(s string) (string, error) {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ipfs.ErrInvalidCID, err)
+	}
+
+	return imageDomain + "/" + cid.NewCidV1(c.Type(), c.Hash()).String() + ":latest", nil
+}
+
+// ImageHandler stores an OCI image archive in IPFS and answers with the
+// image reference to deploy it with. The archive is either the request body
+// or exported from the local containerd if the body names an image as JSON.
+func (s *Server) ImageHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		r := c.Context().RequestBodyStream()
+		if r == nil {
+			r = bytes.NewReader(c.Body())
+		}
+		lr := &limitReader{r: r, n: int64(s.config.MaxBodySize)}
+		r = lr
+
+		if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+			req := imageRequest{}
+			if err := json.NewDecoder(r).Decode(&req); err != nil {
+				if lr.n < 0 {
+					return fiber.ErrRequestEntityTooLarge
+				}
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+
+			pr, pw := io.Pipe()
+			go func() {
+				pw.CloseWithError(s.exportImage(pw, req))
+			}()
+			defer pr.Close()
+			r = pr
+		}
+
+		cid, err := s.ipfs.AddReader(c.Context(), r)
+		if lr.n < 0 {
+			return fiber.ErrRequestEntityTooLarge
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(imageResponse{
+			CID:   cid,
+			Image: imageScheme + cid,
+		})
+	}
+}
+
+// exportImage writes the image archive of a locally stored image.
+func (s *Server) exportImage(w io.Writer, req imageRequest) error {
+	ctx := namespaces.WithNamespace(context.Background(), functionNamespace(req.Namespace))
+
+	named, err := reference.ParseNormalizedNamed(req.Image)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	name := reference.TagNameOnly(named).String()
+
+	return s.containerd.Export(
+		ctx,
+		w,
+		archive.WithImage(s.containerd.ImageService(), name),
+		archive.WithPlatform(platforms.Default()),
+	)
+}
+
+// importImage imports the image archive with the given cid into the local
+// containerd unless it is already present, fetching it from other nodes.
+func (s *Server) importImage(ctx context.Context, namespace, cid string) (string, error) {
+	name, err := imageName(cid)
+	if err != nil {
+		return "", err
+	}
+
+	ctx = namespaces.WithNamespace(ctx, functionNamespace(namespace))
+	_, err = s.containerd.GetImage(ctx, name)
+	if err == nil {
+		return name, nil
+	}
+	if !errdefs.IsNotFound(err) {
+		return "", fmt.Errorf("getting image: %w", err)
+	}
+
+	r, err := s.ipfs.OpenFile(ctx, cid)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	if _, err := s.containerd.Import(ctx, r, containerd.WithIndexName(name)); err != nil {
+		return "", fmt.Errorf("importing image: %w", err)
+	}
+
+	return name, nil
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/clstb/ipfaas/pkg/messages"
+	"github.com/gofiber/fiber/v2"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.uber.org/zap"
+)
+
+// invokeProtocol carries a single function request from the scheduling node
+// to the executing node and the response back. The scheduling node closes
+// its side after writing the request and resets the stream to cancel.
+const invokeProtocol = protocol.ID("/ipfaas/invoke/1.0.0")
+
+// spill reports whether a payload is large enough to be moved through IPFS
+// instead of being sent inline.
+func (s *Server) spill(data []byte) bool {
+	return s.config.SpillThreshold > 0 && len(data) > s.config.SpillThreshold
+}
+
+// spills counts the invocations using each spilled payload stored on this
+// node. Identical payloads share a cid, so a payload is only removed once
+// the last invocation using it finished.
+type spills struct {
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+// addSpill stores a payload in IPFS for the duration of an invocation. It
+// has to be released with releaseSpill.
+func (s *Server) addSpill(ctx context.Context, data []byte) (string, error) {
+	cid, err := s.ipfs.AddFile(ctx, data)
+	if err != nil {
+		return "", err
+	}
+	s.holdSpill(cid)
+
+	return cid, nil
+}
+
+// getSpill fetches a payload spilled by another node. The local copy has to
+// be released with releaseSpill.
+func (s *Server) getSpill(ctx context.Context, cid string) ([]byte, error) {
+	s.holdSpill(cid)
+	data, err := s.ipfs.GetFile(ctx, cid)
+	if err != nil {
+		s.releaseSpill(cid)
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (s *Server) holdSpill(cid string) {
+	s.spills.mu.Lock()
+	defer s.spills.mu.Unlock()
+
+	s.spills.refs[cid]++
+}
+
+// releaseSpill removes a spilled payload once no invocation uses it anymore.
+func (s *Server) releaseSpill(cid string) {
+	s.spills.mu.Lock()
+	defer s.spills.mu.Unlock()
+
+	s.spills.refs[cid]--
+	if s.spills.refs[cid] > 0 {
+		return
+	}
+	delete(s.spills.refs, cid)
+
+	if err := s.ipfs.RemoveFile(context.Background(), cid); err != nil {
+		s.logger.Error("removing spilled payload", zap.String("cid", cid), zap.Error(err))
+	}
+}
+
+func (s *Server) handleInvokeStream(stream network.Stream) {
+	defer stream.Close()
+
+	functionRequest := messages.FunctionRequest{}
+	if err := msgpack.NewDecoder(stream).Decode(&functionRequest); err != nil {
+		s.logger.Error("decoding function request", zap.Error(err))
+		stream.Reset()
+		return
+	}
+
+	timeout := functionRequest.Timeout
+	if timeout <= 0 {
+		timeout = s.functionTimeout(functionRequest.FunctionName)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	go func() {
+		// Anything but EOF means the scheduling node gave up.
+		if _, err := io.Copy(io.Discard, stream); err != nil {
+			cancel()
+		}
+	}()
+
+	if functionRequest.Spilled {
+		cid := string(functionRequest.Data)
+		s.holdSpill(cid)
+		defer s.releaseSpill(cid)
+	}
+
+	functionResponse, err := s.executeFunctionRequest(ctx, functionRequest)
+	if err != nil {
+		s.logger.Error(
+			"executing function request",
+			zap.String("function", functionRequest.FunctionName),
+			zap.String("request", functionRequest.RequestId),
+			zap.Error(err),
+		)
+		functionResponse = errorResponse(functionRequest, err)
+	}
+	functionResponse.NodeId = s.ipfs.NodeId
+
+	if s.spill(functionResponse.Data) && !functionResponse.IsCID {
+		cid, err := s.addSpill(ctx, functionResponse.Data)
+		if err != nil {
+			s.logger.Error("spilling function response", zap.Error(err))
+			functionResponse = errorResponse(functionRequest, err)
+			functionResponse.NodeId = s.ipfs.NodeId
+		} else {
+			functionResponse.Data = []byte(cid)
+			functionResponse.Spilled = true
+			// The scheduling node fetches the response before the
+			// invocation times out on its side, which happens no later
+			// than here.
+			deadline, _ := ctx.Deadline()
+			time.AfterFunc(time.Until(deadline), func() { s.releaseSpill(cid) })
+		}
+	}
+
+	if err := msgpack.NewEncoder(stream).Encode(&functionResponse); err != nil {
+		s.logger.Error("encoding function response", zap.Error(err))
+		stream.Reset()
+	}
+}
+
+// invoke executes a function request on another node. Remote failures are
+// returned as *fiber.Error carrying the status code reported by the node.
+func (s *Server) invoke(
+	ctx context.Context,
+	nodeId string,
+	functionRequest messages.FunctionRequest,
+) (messages.FunctionResponse, error) {
+	if s.spill(functionRequest.Data) && !functionRequest.IsCID {
+		cid, err := s.addSpill(ctx, functionRequest.Data)
+		if err != nil {
+			return messages.FunctionResponse{}, fmt.Errorf("spilling function request: %w", err)
+		}
+		defer s.releaseSpill(cid)
+		functionRequest.Data = []byte(cid)
+		functionRequest.IsCID = true
+		functionRequest.Spilled = true
+	}
+
+	stream, err := s.ipfs.NewStream(ctx, nodeId, invokeProtocol)
+	if err != nil {
+		return messages.FunctionResponse{}, fiber.NewError(
+			fiber.StatusBadGateway,
+			fmt.Sprintf("opening stream to node %s: %s", nodeId, err),
+		)
+	}
+
+	type result struct {
+		res messages.FunctionResponse
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		var r result
+		defer func() { ch <- r }()
+
+		if r.err = msgpack.NewEncoder(stream).Encode(&functionRequest); r.err != nil {
+			return
+		}
+		if r.err = stream.CloseWrite(); r.err != nil {
+			return
+		}
+		r.err = msgpack.NewDecoder(stream).Decode(&r.res)
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			stream.Reset()
+			return r.res, fiber.NewError(
+				fiber.StatusBadGateway,
+				fmt.Sprintf("invoking function on node %s: %s", nodeId, r.err),
+			)
+		}
+		stream.Close()
+
+		if r.res.Error != "" {
+			return r.res, fiber.NewError(r.res.StatusCode, r.res.Error)
+		}
+
+		if r.res.Spilled {
+			cid := string(r.res.Data)
+			data, err := s.getSpill(ctx, cid)
+			if err != nil {
+				return r.res, fiber.NewError(
+					fiber.StatusBadGateway,
+					fmt.Sprintf("fetching spilled function response: %s", err),
+				)
+			}
+			s.releaseSpill(cid)
+			r.res.Data = data
+			r.res.Spilled = false
+		}
+		return r.res, nil
+	case <-ctx.Done():
+		stream.Reset()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return messages.FunctionResponse{}, fiber.NewError(
+				fiber.StatusGatewayTimeout,
+				fmt.Sprintf("function %s timed out on node %s", functionRequest.FunctionName, nodeId),
+			)
+		}
+		return messages.FunctionResponse{}, ctx.Err()
+	}
+}
@@ -0,0 +1,513 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/clstb/ipfaas/pkg/messages"
+	"github.com/clstb/ipfaas/pkg/resolver"
+	"github.com/gofiber/fiber/v2"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.uber.org/zap"
+)
+
+// queueProtocol lets nodes with spare capacity pull queued requests from the
+// node they were submitted to and report the outcome back to it.
+const queueProtocol = protocol.ID("/ipfaas/queue/1.0.0")
+
+const (
+	annotationMaxConcurrency = "ipfaas.max-concurrency"
+
+	// leaseGrace is added to the function timeout when leasing a queued
+	// request, so it is only handed out again once the first attempt surely
+	// ended.
+	leaseGrace = 10 * time.Second
+
+	// pullTimeout bounds pulling a queued request from another node, so an
+	// unreachable node does not hold up work queued elsewhere.
+	pullTimeout = 2 * time.Second
+)
+
+// maxConcurrency returns the number of requests a node runs concurrently
+// for a function, read from its "ipfaas.max-concurrency" annotation and
+// falling back to the configured default.
+func (s *Server) maxConcurrency(functionName string) int {
+	v, ok := s.annotations(functionName)[annotationMaxConcurrency]
+	if !ok {
+		return s.config.QueueConcurrency
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		s.logger.Warn(
+			"invalid function concurrency",
+			zap.String("function", functionName),
+			zap.String("concurrency", v),
+		)
+		return s.config.QueueConcurrency
+	}
+
+	return n
+}
+
+// enqueue stores a function request in the queue of this node and wakes up
+// the worker.
+func (s *Server) enqueue(ctx context.Context, item messages.QueueItem) error {
+	item.Origin = s.ipfs.NodeId
+	item.EnqueuedAt = time.Now()
+	if err := s.queue.Push(ctx, item); err != nil {
+		return err
+	}
+
+	select {
+	case s.queueNotify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// wait enqueues a function request that could not be scheduled and waits
+// for a node to run it.
+func (s *Server) wait(
+	ctx context.Context,
+	item messages.QueueItem,
+) (messages.FunctionResponse, error) {
+	ch := make(chan messages.FunctionResponse, 1)
+	s.waiting.Store(item.Id, ch)
+	defer s.waiting.Delete(item.Id)
+
+	if err := s.enqueue(ctx, item); err != nil {
+		return messages.FunctionResponse{}, fmt.Errorf("enqueuing function request: %w", err)
+	}
+
+	t := time.NewTimer(s.config.QueueTimeout)
+	defer t.Stop()
+
+	select {
+	case res := <-ch:
+		if res.Error != "" {
+			return res, fiber.NewError(res.StatusCode, res.Error)
+		}
+		return res, nil
+	case <-t.C:
+	case <-ctx.Done():
+	}
+
+	if _, _, err := s.queue.Ack(context.Background(), item.Id); err != nil {
+		s.logger.Error("removing queue item", zap.Error(err))
+	}
+
+	return messages.FunctionResponse{}, fiber.NewError(
+		fiber.StatusGatewayTimeout,
+		fmt.Sprintf("function %s did not leave the queue in time", item.Request.FunctionName),
+	)
+}
+
+// deployed reports whether this or any other node has a function deployed,
+// so requests to it can eventually run.
+func (s *Server) deployed(functionName string) bool {
+	if _, ok := s.resolver.Function(functionName); ok {
+		return true
+	}
+
+	return s.scheduler.Deployed(functionName)
+}
+
+// expire fails the queued requests that waited longer than the maximum
+// queue age, e.g. because the function was deleted after they were queued.
+func (s *Server) expire(ctx context.Context) {
+	items, err := s.queue.Expire(ctx, time.Now().Add(-s.config.QueueMaxAge))
+	if err != nil {
+		s.logger.Error("expiring queue items", zap.Error(err))
+	}
+
+	for _, item := range items {
+		err := fiber.NewError(
+			fiber.StatusGatewayTimeout,
+			fmt.Sprintf("function %s did not leave the queue in time", item.Request.FunctionName),
+		)
+		res := errorResponse(item.Request, err)
+		res.Data = []byte(res.Error)
+
+		if v, ok := s.waiting.Load(item.Id); ok {
+			v.(chan messages.FunctionResponse) <- res
+			continue
+		}
+		go s.deliver(item.Id, item.CallbackUrl, time.Since(item.EnqueuedAt), res)
+	}
+}
+
+// requeue returns a leased item to the queue, counting an attempt if it
+// failed.
+func (s *Server) requeue(ctx context.Context, id string, failed bool) error {
+	unlease := s.queue.Release
+	if failed {
+		unlease = s.queue.Nack
+	}
+	if err := unlease(ctx, id); err != nil {
+		return err
+	}
+
+	return s.calls.Update(ctx, id, func(call *messages.Call) {
+		call.Status = messages.CallQueued
+		call.NodeId = ""
+		call.StartedAt = nil
+	})
+}
+
+// complete removes a finished item from the queue and hands its response to
+// the waiting caller or delivers it like an asynchronous call.
+func (s *Server) complete(ctx context.Context, id string, res messages.FunctionResponse) error {
+	item, ok, err := s.queue.Ack(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// The caller gave up or the item already completed after its lease
+		// expired.
+		return nil
+	}
+
+	if v, ok := s.waiting.Load(id); ok {
+		v.(chan messages.FunctionResponse) <- res
+		return nil
+	}
+
+	s.deliver(item.Id, item.CallbackUrl, time.Since(item.EnqueuedAt), res)
+	return nil
+}
+
+func (s *Server) handleQueueStream(stream network.Stream) {
+	defer stream.Close()
+
+	queueRequest := messages.QueueRequest{}
+	if err := msgpack.NewDecoder(stream).Decode(&queueRequest); err != nil {
+		s.logger.Error("decoding queue request", zap.Error(err))
+		stream.Reset()
+		return
+	}
+
+	ctx := context.Background()
+	queueResponse := messages.QueueResponse{}
+	var err error
+	switch queueRequest.Op {
+	case messages.QueuePull:
+		item, ok := s.queue.Pop(
+			queueRequest.FunctionName,
+			s.functionTimeout(queueRequest.FunctionName)+leaseGrace,
+		)
+		if ok {
+			queueResponse.Item = &item
+			s.started(ctx, item.Id, queueRequest.NodeId)
+		}
+	case messages.QueueComplete:
+		res := queueRequest.Response
+		if res.Spilled {
+			if res.Data, err = s.ipfs.GetFile(ctx, string(res.Data)); err != nil {
+				break
+			}
+			res.Spilled = false
+		}
+		err = s.complete(ctx, queueRequest.Id, res)
+	case messages.QueueNack:
+		err = s.requeue(ctx, queueRequest.Id, true)
+	case messages.QueueRelease:
+		err = s.requeue(ctx, queueRequest.Id, false)
+	default:
+		err = fmt.Errorf("unknown queue operation: %s", queueRequest.Op)
+	}
+	if err != nil {
+		s.logger.Error(
+			"handling queue request",
+			zap.String("op", queueRequest.Op),
+			zap.Error(err),
+		)
+		queueResponse.Error = err.Error()
+	}
+
+	if err := msgpack.NewEncoder(stream).Encode(&queueResponse); err != nil {
+		s.logger.Error("encoding queue response", zap.Error(err))
+		stream.Reset()
+	}
+}
+
+// queueRequest sends a queue operation to another node.
+func (s *Server) queueRequest(
+	ctx context.Context,
+	nodeId string,
+	queueRequest messages.QueueRequest,
+) (messages.QueueResponse, error) {
+	queueRequest.NodeId = s.ipfs.NodeId
+
+	queueResponse := messages.QueueResponse{}
+	if err := s.request(ctx, nodeId, queueProtocol, &queueRequest, &queueResponse); err != nil {
+		return queueResponse, err
+	}
+	if queueResponse.Error != "" {
+		return queueResponse, fmt.Errorf("node %s: %s", nodeId, queueResponse.Error)
+	}
+
+	return queueResponse, nil
+}
+
+// pull leases the next queued request of a function from the local queue.
+func (s *Server) pull(ctx context.Context, functionName string) (messages.QueueItem, bool) {
+	item, ok := s.queue.Pop(functionName, s.functionTimeout(functionName)+leaseGrace)
+	if ok {
+		s.started(ctx, item.Id, s.ipfs.NodeId)
+	}
+
+	return item, ok
+}
+
+// pullRemote leases the next queued request of a function from the other
+// nodes advertising queued requests. All nodes are asked at once and the
+// first item received is taken. Items received later are released again.
+func (s *Server) pullRemote(ctx context.Context, functionName string) (messages.QueueItem, bool) {
+	var nodeIds []string
+	for _, nodeId := range s.scheduler.Queues(functionName) {
+		if nodeId != s.ipfs.NodeId {
+			nodeIds = append(nodeIds, nodeId)
+		}
+	}
+
+	items := make(chan *messages.QueueItem, len(nodeIds))
+	for _, nodeId := range nodeIds {
+		go func(nodeId string) {
+			ctx, cancel := context.WithTimeout(ctx, pullTimeout)
+			defer cancel()
+
+			res, err := s.queueRequest(ctx, nodeId, messages.QueueRequest{
+				Op:           messages.QueuePull,
+				FunctionName: functionName,
+			})
+			if err != nil {
+				s.logger.Warn("pulling queue item", zap.String("node", nodeId), zap.Error(err))
+			}
+			items <- res.Item
+		}(nodeId)
+	}
+
+	for i := range nodeIds {
+		item := <-items
+		if item == nil {
+			continue
+		}
+
+		go s.releaseItems(items, len(nodeIds)-i-1)
+		return *item, true
+	}
+
+	return messages.QueueItem{}, false
+}
+
+// releaseItems returns the items of the remaining n pulls to their origin.
+func (s *Server) releaseItems(items <-chan *messages.QueueItem, n int) {
+	for i := 0; i < n; i++ {
+		item := <-items
+		if item == nil {
+			continue
+		}
+
+		if _, err := s.queueRequest(context.Background(), item.Origin, messages.QueueRequest{
+			Op: messages.QueueRelease,
+			Id: item.Id,
+		}); err != nil {
+			s.logger.Warn("releasing queue item", zap.String("item", item.Id), zap.Error(err))
+		}
+	}
+}
+
+// finish reports the outcome of a queued request to the node it was queued
+// on. Failed attempts of idempotent functions are returned to the queue as
+// long as attempts are left.
+func (s *Server) finish(
+	ctx context.Context,
+	item messages.QueueItem,
+	res messages.FunctionResponse,
+	err error,
+) error {
+	if err != nil {
+		functionName := item.Request.FunctionName
+		if retryable(ctx, err) && s.idempotent(functionName) && item.Attempts+1 < s.config.RetryMaxAttempts {
+			if item.Origin == s.ipfs.NodeId {
+				return s.requeue(ctx, item.Id, true)
+			}
+			_, err := s.queueRequest(ctx, item.Origin, messages.QueueRequest{
+				Op: messages.QueueNack,
+				Id: item.Id,
+			})
+			return err
+		}
+
+		res = errorResponse(item.Request, err)
+		res.Data = []byte(res.Error)
+		res.NodeId = s.ipfs.NodeId
+	}
+
+	if item.Origin == s.ipfs.NodeId {
+		return s.complete(ctx, item.Id, res)
+	}
+
+	if s.spill(res.Data) && !res.IsCID {
+		cid, err := s.addSpill(ctx, res.Data)
+		if err != nil {
+			return fmt.Errorf("spilling function response: %w", err)
+		}
+		// The origin fetched the response once it answered.
+		defer s.releaseSpill(cid)
+		res.Data = []byte(cid)
+		res.Spilled = true
+	}
+	_, err = s.queueRequest(ctx, item.Origin, messages.QueueRequest{
+		Op:       messages.QueueComplete,
+		Id:       item.Id,
+		Response: res,
+	})
+	return err
+}
+
+// worker runs queued requests of the functions deployed on this node as long
+// as they have capacity left.
+type worker struct {
+	mu      sync.Mutex
+	running map[string]int
+	// pulling holds the functions with a pull from other nodes in progress.
+	pulling map[string]struct{}
+}
+
+func (w *worker) acquire(functionName string, limit int) (func(), bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if limit > 0 && w.running[functionName] >= limit {
+		return nil, false
+	}
+	w.running[functionName]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.running[functionName]--
+		})
+	}, true
+}
+
+// startPull reports whether a pull from other nodes may start for a
+// function, which is the case if none is in progress.
+func (w *worker) startPull(functionName string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.pulling[functionName]; ok {
+		return false
+	}
+	w.pulling[functionName] = struct{}{}
+
+	return true
+}
+
+func (w *worker) endPull(functionName string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.pulling, functionName)
+}
+
+func (s *Server) work(ctx context.Context) {
+	w := &worker{
+		running: map[string]int{},
+		pulling: map[string]struct{}{},
+	}
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-s.queueNotify:
+		}
+
+		if s.config.QueueMaxAge > 0 {
+			s.expire(ctx)
+		}
+
+		// Scaled down functions only pull work if no node runs a replica,
+		// since pulling scales them up.
+		var functionNames []string
+		s.resolver.FunctionURLs.Range(func(key, value interface{}) bool {
+			function := value.(*resolver.Function)
+			if function.ExpiresAt.Before(time.Now()) {
+				return true
+			}
+			if function.IP != "" || len(s.scheduler.Running(function.QualifiedName())) == 0 {
+				functionNames = append(functionNames, function.QualifiedName())
+			}
+			return true
+		})
+
+		for _, functionName := range functionNames {
+			limit := s.maxConcurrency(functionName)
+			for limit <= 0 || s.executions.Inflight(functionName) < limit {
+				release, ok := w.acquire(functionName, limit)
+				if !ok {
+					break
+				}
+
+				item, ok := s.pull(ctx, functionName)
+				if ok {
+					go s.run(ctx, item, release)
+					continue
+				}
+
+				// Pulls from other nodes run outside of the loop, so slow
+				// nodes do not hold up local work.
+				if !w.startPull(functionName) {
+					release()
+					break
+				}
+				go func(functionName string) {
+					item, ok := s.pullRemote(ctx, functionName)
+					w.endPull(functionName)
+					if !ok {
+						release()
+						return
+					}
+
+					// Look for more work while this item runs.
+					select {
+					case s.queueNotify <- struct{}{}:
+					default:
+					}
+					s.run(ctx, item, release)
+				}(functionName)
+				break
+			}
+		}
+	}
+}
+
+// run executes a queued request and reports its outcome.
+func (s *Server) run(ctx context.Context, item messages.QueueItem, release func()) {
+	defer release()
+
+	res, err := s.handle(ctx, item.Request, s.functionTimeout(item.Request.FunctionName))
+	if err := s.finish(ctx, item, res, err); err != nil {
+		s.logger.Error(
+			"finishing queue item",
+			zap.String("function", item.Request.FunctionName),
+			zap.String("item", item.Id),
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/clstb/ipfaas/pkg/resolver"
+	"github.com/gofiber/fiber/v2"
+	"github.com/openfaas/faas-provider/types"
+	"github.com/openfaas/faasd/pkg/provider/handlers"
+)
+
+// runHandler runs a faasd handler on this node and turns error responses
+// into a *fiber.Error.
+func runHandler(handler http.HandlerFunc, method, target string, body []byte) error {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code >= http.StatusBadRequest {
+		return fiber.NewError(rec.Code, strings.TrimSpace(rec.Body.String()))
+	}
+
+	return nil
+}
+
+// DeleteHandler deletes a function together with all its replica
+// containers. faasd only knows the container named like the function.
+func (s *Server) DeleteHandler() fiber.Handler {
+	deleteHandler := handlers.MakeDeleteHandler(s.containerd, s.cni)
+
+	return func(c *fiber.Ctx) error {
+		req := types.DeleteFunctionRequest{}
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		namespace := c.Query("namespace")
+		target := "/system/functions?namespace=" + url.QueryEscape(namespace)
+
+		containers := []string{req.FunctionName}
+		if function, ok := s.resolver.Function(resolver.QualifiedName(req.FunctionName, namespace)); ok {
+			containers = function.Containers
+		}
+
+		// Replicas go first, so a failure leaves the function in place to
+		// retry the delete.
+		for _, container := range containers {
+			if container == req.FunctionName {
+				continue
+			}
+			if err := deleteContainer(deleteHandler, target, container); err != nil {
+				return err
+			}
+		}
+		if err := deleteContainer(deleteHandler, target, req.FunctionName); err != nil {
+			return err
+		}
+
+		return c.SendStatus(fiber.StatusOK)
+	}
+}
+
+func deleteContainer(deleteHandler http.HandlerFunc, target, container string) error {
+	body, err := json.Marshal(&types.DeleteFunctionRequest{
+		FunctionName: container,
+	})
+	if err != nil {
+		return err
+	}
+
+	return runHandler(deleteHandler, http.MethodDelete, target, body)
+}
+
+// UpdateHandler updates a function and recreates its replica containers
+// from the same deployment spec. Specs are prepared like deployments, so
+// constraints are kept and images referenced by cid are imported instead of
+// pulled.
+func (s *Server) UpdateHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		body, imported, err := s.prepareDeployment(c.Context(), c.Body())
+		if err != nil {
+			return err
+		}
+
+		updateHandler := handlers.MakeUpdateHandler(s.containerd, s.cni, "", s.config.AlwaysPull && !imported)
+
+		req := types.FunctionDeployment{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		if err := runHandler(updateHandler, http.MethodPut, "/system/functions", body); err != nil {
+			return err
+		}
+
+		function, ok := s.resolver.Function(resolver.QualifiedName(req.Service, req.Namespace))
+		if !ok {
+			return c.SendStatus(fiber.StatusOK)
+		}
+
+		for _, container := range function.Containers {
+			if container == req.Service {
+				continue
+			}
+
+			replica := req
+			replica.Service = container
+			labels := map[string]string{}
+			if req.Labels != nil {
+				for k, v := range *req.Labels {
+					labels[k] = v
+				}
+			}
+			labels[resolver.LabelReplicaOf] = req.Service
+			replica.Labels = &labels
+
+			body, err := json.Marshal(&replica)
+			if err != nil {
+				return err
+			}
+			if body, _, err = s.prepareDeployment(c.Context(), body); err != nil {
+				return err
+			}
+			if err := runHandler(updateHandler, http.MethodPut, "/system/functions", body); err != nil {
+				return err
+			}
+		}
+
+		return c.SendStatus(fiber.StatusOK)
+	}
+}
@@ -1,41 +1,75 @@
 package server
 
 import (
+	"io"
+
 	"github.com/gofiber/adaptor/v2"
 	"github.com/gofiber/fiber/v2"
 	"github.com/openfaas/faas-provider/logs"
 	faasdlogs "github.com/openfaas/faasd/pkg/logs"
 	"github.com/openfaas/faasd/pkg/provider/handlers"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func (s *Server) routes() {
-	readHandler := handlers.MakeReadHandler(s.containerd)
-	deployHandler := handlers.MakeDeployHandler(s.containerd, s.cni, "", true) // TODO
-	deleteHandler := handlers.MakeDeleteHandler(s.containerd, s.cni)
-	updateHandler := handlers.MakeUpdateHandler(s.containerd, s.cni, "", true) // TODO
-	replicaUpdateHandler := handlers.MakeReplicaUpdateHandler(s.containerd, s.cni)
-	replicaReaderHandler := handlers.MakeReplicaReaderHandler(s.containerd)
 	secretHandler := handlers.MakeSecretHandler(s.containerd.NamespaceService(), "") // TODO
 	logHandler := logs.NewLogHandlerFunc(faasdlogs.New(), 0)                         // TODO
 	namespacesLister := handlers.MakeNamespacesLister(s.containerd)
 	functionHandler := s.FunctionHandler()
+	asyncFunctionHandler := s.AsyncFunctionHandler()
+
+	s.Use(limitBody(fiber.DefaultBodyLimit, imagesPath))
 
-	s.Get("/system/functions", adaptor.HTTPHandlerFunc(readHandler))
-	s.Post("/system/functions", adaptor.HTTPHandlerFunc(deployHandler))
-	s.Delete("/system/functions", adaptor.HTTPHandlerFunc(deleteHandler))
-	s.Put("/system/functions", adaptor.HTTPHandlerFunc(updateHandler))
+	s.Get("/system/functions", s.ReadHandler())
+	s.Post("/system/functions", s.DeployHandler())
+	s.Delete("/system/functions", s.DeleteHandler())
+	s.Put("/system/functions", s.UpdateHandler())
 
-	s.Post(`/system/scale-function/:name`, adaptor.HTTPHandlerFunc(replicaUpdateHandler))
-	s.Get(`/system/function/:name`, adaptor.HTTPHandlerFunc(replicaReaderHandler))
+	s.Post(`/system/scale-function/:name`, s.ScaleHandler())
+	s.Get(`/system/function/:name`, s.ReplicaReaderHandler())
+	s.Get("/system/discovery", s.DiscoveryHandler())
 	s.Get("/system/info", func(c *fiber.Ctx) error { return nil })
 
 	s.All("/system/secrets", adaptor.HTTPHandlerFunc(secretHandler))
 	s.Get("/system/logs", adaptor.HTTPHandlerFunc(logHandler))
 
 	s.Get("/system/namespaces", adaptor.HTTPHandlerFunc(namespacesLister))
+	s.Post(imagesPath, s.ImageHandler())
+	s.Get("/system/calls/:id", s.CallHandler())
 
 	s.All("/function/:name", functionHandler)
 	s.All("/function/:name/*", functionHandler)
+	s.All("/async-function/:name", asyncFunctionHandler)
+	s.All("/async-function/:name/*", asyncFunctionHandler)
 
 	s.Get("/healthz", func(c *fiber.Ctx) error { return nil })
+	s.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+}
+
+// limitBody rejects request bodies above limit with 413. Bodies above the
+// limit of the app are streamed, so they are read up to the limit here. The
+// given paths are skipped and handle the stream themselves.
+func limitBody(limit int, skip ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		req := c.Request()
+		if !req.IsBodyStream() {
+			return c.Next()
+		}
+		for _, path := range skip {
+			if c.Path() == path {
+				return c.Next()
+			}
+		}
+
+		body, err := io.ReadAll(io.LimitReader(c.Context().RequestBodyStream(), int64(limit)+1))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if len(body) > limit {
+			return fiber.ErrRequestEntityTooLarge
+		}
+		req.SetBody(body)
+
+		return c.Next()
+	}
 }
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/clstb/ipfaas/pkg/resolver"
+	"github.com/gofiber/fiber/v2"
+	"github.com/openfaas/faas-provider/types"
+	"github.com/openfaas/faasd/pkg/provider/handlers"
+	"go.uber.org/zap"
+)
+
+// labelScaleZero opts a function out of scaling to zero if set to "false".
+const labelScaleZero = "com.openfaas.scale.zero"
+
+// readyInterval is how often a resumed replica is probed until it accepts
+// connections.
+const readyInterval = 100 * time.Millisecond
+
+// scale sets the replicas of a local function, given by its qualified name,
+// through the faasd replica handler, which pauses the tasks of its
+// containers for 0 replicas and resumes or recreates them otherwise.
+func (s *Server) scale(name string, replicas uint64) error {
+	function, ok := s.resolver.Function(name)
+	if !ok {
+		return fmt.Errorf("unable to find function: %s", name)
+	}
+
+	for _, container := range function.Containers {
+		body, err := json.Marshal(&types.ScaleServiceRequest{
+			ServiceName: container,
+			Replicas:    replicas,
+		})
+		if err != nil {
+			return fmt.Errorf("marshalling scale request: %w", err)
+		}
+
+		if err := runHandler(
+			handlers.MakeReplicaUpdateHandler(s.containerd, s.cni),
+			http.MethodPost,
+			"/system/scale-function/"+container+"?namespace="+url.QueryEscape(function.Namespace),
+			body,
+		); err != nil {
+			return fmt.Errorf("scaling container %s: %w", container, err)
+		}
+	}
+
+	return nil
+}
+
+// ScaleHandler sets the replicas of a local function, including the
+// containers it was replicated to.
+func (s *Server) ScaleHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		req := types.ScaleServiceRequest{}
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		serviceName := req.ServiceName
+		if serviceName == "" {
+			serviceName = c.Params("name")
+		}
+		name := resolver.QualifiedName(serviceName, c.Query("namespace"))
+		if _, ok := s.resolver.Function(name); !ok {
+			return fiber.NewError(
+				fiber.StatusNotFound,
+				fmt.Sprintf("function not found: %s", name),
+			)
+		}
+
+		return s.scale(name, req.Replicas)
+	}
+}
+
+// scaleUp starts the replicas of a scaled down local function and waits
+// until one accepts connections. Concurrent requests wait for the same replica.
+func (s *Server) scaleUp(ctx context.Context, name string) (string, error) {
+	v, _ := s.scaling.LoadOrStore(name, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if addr, ok := s.resolver.Resolve(name); ok {
+		return addr, nil
+	}
+
+	s.logger.Info("scaling up function", zap.String("function", name))
+	if err := s.scale(name, 1); err != nil {
+		return "", err
+	}
+
+	t := time.NewTicker(readyInterval)
+	defer t.Stop()
+	for {
+		function, err := s.resolver.Refresh(name)
+		if err != nil {
+			return "", fmt.Errorf("refreshing function: %w", err)
+		}
+		for _, replica := range function.ReplicaSet {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(replica.IP, "8080"), readyInterval)
+			if err == nil {
+				conn.Close()
+				return replica.Addr(), nil
+			}
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// scaleDown pauses local functions that did not execute for the configured
+// inactivity window.
+func (s *Server) scaleDown(ctx context.Context) {
+	// runningSince keeps replicas that were just started or discovered from
+	// being paused before they had a chance to serve.
+	runningSince := map[string]time.Time{}
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		var functions []*resolver.Function
+		s.resolver.FunctionURLs.Range(func(key, value interface{}) bool {
+			functions = append(functions, value.(*resolver.Function))
+			return true
+		})
+
+		running := map[string]struct{}{}
+		for _, function := range functions {
+			if function.IP == "" {
+				continue
+			}
+			name := function.QualifiedName()
+			running[name] = struct{}{}
+			if _, ok := runningSince[name]; !ok {
+				runningSince[name] = time.Now()
+			}
+
+			if function.Labels[labelScaleZero] == "false" {
+				continue
+			}
+			if time.Since(runningSince[name]) < s.config.ScaleToZeroAfter {
+				continue
+			}
+			if s.scaleDownIdle(name) {
+				delete(running, name)
+			}
+		}
+		for name := range runningSince {
+			if _, ok := running[name]; !ok {
+				delete(runningSince, name)
+			}
+		}
+	}
+}
+
+// scaleDownIdle pauses a local function unless it executed recently or has
+// queued requests. It holds the scaling lock of the function, so it does not
+// interleave with scaleUp.
+func (s *Server) scaleDownIdle(name string) bool {
+	v, _ := s.scaling.LoadOrStore(name, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !s.executions.Idle(name, s.config.ScaleToZeroAfter) {
+		return false
+	}
+	if s.queue.Depths()[name] > 0 {
+		return false
+	}
+
+	s.logger.Info("scaling down function", zap.String("function", name))
+	if err := s.scale(name, 0); err != nil {
+		s.logger.Error("scaling down function", zap.Error(err))
+		return false
+	}
+	if _, err := s.resolver.Refresh(name); err != nil {
+		s.logger.Error("refreshing function", zap.Error(err))
+	}
+
+	return true
+}
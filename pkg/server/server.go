@@ -2,12 +2,13 @@ package server
 
 import (
 	"context"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/clstb/ipfaas/pkg/calls"
 	"github.com/clstb/ipfaas/pkg/ipfs"
 	"github.com/clstb/ipfaas/pkg/messages"
+	"github.com/clstb/ipfaas/pkg/queue"
 	"github.com/clstb/ipfaas/pkg/resolver"
 	"github.com/clstb/ipfaas/pkg/scheduler"
 	"github.com/containerd/containerd"
@@ -20,14 +21,58 @@ import (
 	"go.uber.org/zap"
 )
 
+type Config struct {
+	FunctionTimeout  time.Duration
+	RetryMaxAttempts int
+	RetryBudget      time.Duration
+	Scheduler        scheduler.Config
+	// SpillThreshold is the payload size in bytes above which offloaded
+	// requests and responses are exchanged as IPFS files. 0 disables it.
+	SpillThreshold int
+	// QueueConcurrency is the default number of requests per function a node
+	// runs before further requests are queued.
+	QueueConcurrency int
+	// QueueTimeout is how long synchronous requests wait in the queue.
+	QueueTimeout time.Duration
+	// QueueMaxAge is how long asynchronous requests wait in the queue before
+	// their call fails.
+	QueueMaxAge time.Duration
+	// AlwaysPull pulls images from their registry on every deployment.
+	// Images referenced by cid are never pulled.
+	AlwaysPull bool
+	// Labels are advertised to other nodes and matched against function
+	// constraints.
+	Labels map[string]string
+	// ScaleToZeroAfter is the inactivity window after which local functions
+	// are paused. 0 disables scaling to zero.
+	ScaleToZeroAfter time.Duration
+	// MaxBodySize is the maximum size in bytes of image archives uploaded to
+	// /system/images.
+	MaxBodySize int
+	// CallTTL is how long finished asynchronous calls are kept for lookup.
+	CallTTL time.Duration
+	// DeployTimeout bounds deployments on other nodes, which include pulling
+	// or importing the image.
+	DeployTimeout time.Duration
+}
+
 type Server struct {
 	*fiber.App
-	scheduler *scheduler.Scheduler
-	resolver  *resolver.Resolver
-	ipfs      *ipfs.IPFS
-	client    *fasthttp.Client
-	offloads  *sync.Map
-	latencyCh chan<- scheduler.Latency
+	config     Config
+	scheduler  *scheduler.Scheduler
+	executions *scheduler.Executions
+	resolver   *resolver.Resolver
+	ipfs       *ipfs.IPFS
+	client     *fasthttp.Client
+	calls      *calls.Store
+	latencyCh  chan<- scheduler.Latency
+
+	queue       *queue.Queue
+	queueNotify chan struct{}
+	waiting     *sync.Map
+	// scaling holds a mutex per function being scaled up.
+	scaling *sync.Map
+	spills  spills
 
 	containerd *containerd.Client
 	cni        cni.CNI
@@ -40,33 +85,69 @@ func New(
 	containerd *containerd.Client,
 	cni cni.CNI,
 	repository string,
+	config Config,
 ) (*Server, error) {
 	heartbeatCh := make(chan messages.Heartbeat, 10)
 	latencyCh := make(chan scheduler.Latency, 100)
 
-	scheduler := scheduler.New(
+	ipfs, err := ipfs.New(ctx, logger, repository)
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := queue.New(ctx, ipfs.Datastore())
+	if err != nil {
+		return nil, err
+	}
+
+	executions := scheduler.NewExecutions()
+	scheduler, err := scheduler.New(
+		ipfs.NodeId,
+		config.Scheduler,
 		latencyCh,
 		heartbeatCh,
 	)
-
-	ipfs, err := ipfs.New(ctx, logger, repository)
 	if err != nil {
 		return nil, err
 	}
 
 	s := &Server{
-		App:        fiber.New(),
+		// Request bodies above the default limit are streamed, so image
+		// archives are added to IPFS without being buffered in memory
+		// first. Other routes reject them.
+		App: fiber.New(fiber.Config{
+			StreamRequestBody: true,
+		}),
+		config:     config,
 		scheduler:  scheduler,
+		executions: executions,
 		resolver:   resolver.New(containerd),
 		ipfs:       ipfs,
 		client:     &fasthttp.Client{},
-		offloads:   &sync.Map{},
+		calls:      calls.New(ipfs.Datastore()),
 		latencyCh:  latencyCh,
+
+		queue:       queue,
+		queueNotify: make(chan struct{}, 1),
+		waiting:     &sync.Map{},
+		scaling:     &sync.Map{},
+		spills:      spills{refs: map[string]int{}},
+
 		containerd: containerd,
 		cni:        cni,
 		logger:     logger,
 	}
 
+	s.ipfs.SetStreamHandler(invokeProtocol, s.handleInvokeStream)
+	s.ipfs.SetStreamHandler(queueProtocol, s.handleQueueStream)
+	s.ipfs.SetStreamHandler(callsProtocol, s.handleCallsStream)
+	s.ipfs.SetStreamHandler(deployProtocol, s.handleDeployStream)
+	go s.work(ctx)
+	go s.pruneCalls(ctx)
+	if config.ScaleToZeroAfter > 0 {
+		go s.scaleDown(ctx)
+	}
+
 	if err := s.ipfs.Subscribe(ctx, "heartbeats"); err != nil {
 		return nil, err
 	}
@@ -76,49 +157,12 @@ func New(
 			topic := msg.Topics()[0]
 			var err error
 			switch {
-			case strings.HasSuffix(topic, "_responses"):
-				if msg.From().String() == ipfs.NodeId {
-					continue
-				}
-
-				functionResponse := messages.FunctionResponse{}
-				if err = msgpack.Unmarshal(msg.Data(), &functionResponse); err != nil {
-					continue
-				}
-
-				v, ok := s.offloads.Load(functionResponse.RequestId)
-				if !ok {
-					continue
-				}
-				ch := v.(chan messages.FunctionResponse)
-				ch <- functionResponse
-			case strings.HasSuffix(topic, "_requests"):
-				if msg.From().String() == ipfs.NodeId {
-					continue
-				}
-
-				functionRequest := messages.FunctionRequest{}
-				if err := msgpack.Unmarshal(msg.Data(), &functionRequest); err != nil {
-					continue
-				}
-
-				if functionRequest.NodeId != s.ipfs.NodeId {
-					continue
-				}
-
-				go s.handleFunctionRequest(functionRequest)
 			case topic == "heartbeats":
 				heartbeat := messages.Heartbeat{}
 				if err = msgpack.Unmarshal(msg.Data(), &heartbeat); err != nil {
-					return
+					break
 				}
 
-				if msg.From().String() == ipfs.NodeId {
-					for _, function := range heartbeat.Functions {
-						err = s.ipfs.Subscribe(ctx, function+"_requests")
-						err = s.ipfs.Subscribe(ctx, function+"_responses")
-					}
-				}
 				heartbeatCh <- heartbeat
 			}
 			if err != nil {
@@ -141,21 +185,36 @@ func New(
 				continue
 			}
 
-			var functions []string
+			var functions, scaledDown []string
+			annotations := map[string]map[string]string{}
+			details := map[string]messages.FunctionDetails{}
 			s.resolver.FunctionURLs.Range(func(key, value interface{}) bool {
 				function := value.(*resolver.Function)
 				if function.ExpiresAt.Before(time.Now()) {
 					return true
 				}
-				functions = append(functions, function.Name)
+				if function.IP == "" {
+					scaledDown = append(scaledDown, function.QualifiedName())
+				} else {
+					functions = append(functions, function.QualifiedName())
+				}
+				annotations[function.QualifiedName()] = function.Annotations
+				details[function.QualifiedName()] = function.Details()
 				return true
 			})
 
 			heartbeat := messages.Heartbeat{
-				NodeId:    s.ipfs.NodeId,
-				UsedMEM:   mem.UsedPercent,
-				UsedCPU:   cpu[0],
-				Functions: functions,
+				NodeId:      s.ipfs.NodeId,
+				UsedMEM:     mem.UsedPercent,
+				UsedCPU:     cpu[0],
+				Functions:   functions,
+				ScaledDown:  scaledDown,
+				Annotations: annotations,
+				Blocks:      s.ipfs.RecentBlocks(),
+				Stats:       s.executions.Stats(),
+				Queued:      s.queue.Depths(),
+				Labels:      s.config.Labels,
+				Details:     details,
 			}
 
 			b, err := msgpack.Marshal(&heartbeat)
@@ -164,7 +223,7 @@ func New(
 				continue
 			}
 
-			if err := s.ipfs.PubSub().Publish(ctx, "heartbeats", b); err != nil {
+			if err := s.ipfs.Publish(ctx, "heartbeats", b); err != nil {
 				s.logger.Error("publishing message", zap.Error(err))
 			}
 		}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// streamTimeout bounds control requests exchanged with other nodes.
+const streamTimeout = 10 * time.Second
+
+// request sends req to another node over a new stream of the given protocol
+// and decodes the answer into res.
+func (s *Server) request(
+	ctx context.Context,
+	nodeId string,
+	protocol protocol.ID,
+	req interface{},
+	res interface{},
+) error {
+	return s.requestTimeout(ctx, streamTimeout, nodeId, protocol, req, res)
+}
+
+// requestTimeout is request with a deadline other than streamTimeout, for
+// requests that take long to answer.
+func (s *Server) requestTimeout(
+	ctx context.Context,
+	timeout time.Duration,
+	nodeId string,
+	protocol protocol.ID,
+	req interface{},
+	res interface{},
+) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stream, err := s.ipfs.NewStream(ctx, nodeId, protocol)
+	if err != nil {
+		return fmt.Errorf("opening stream to node %s: %w", nodeId, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	if err := msgpack.NewEncoder(stream).Encode(req); err != nil {
+		stream.Reset()
+		return fmt.Errorf("encoding request: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		stream.Reset()
+		return fmt.Errorf("closing stream: %w", err)
+	}
+	if err := msgpack.NewDecoder(stream).Decode(res); err != nil {
+		stream.Reset()
+		return fmt.Errorf("decoding response: %w", err)
+	}
+
+	return stream.Close()
+}
+
+// timedOut reports whether a request failed because its deadline passed
+// rather than because the other node refused it.
+func timedOut(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}